@@ -0,0 +1,184 @@
+package minimalist_http2
+
+import (
+	"fmt"
+	"github.com/Jxck/logger"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default freshness lifetime of an alternative service (RFC 7838 section 3.1)
+const DefaultAltSvcMaxAge = 24 * time.Hour
+
+// AltSvc is one alternative service advertised for an origin
+//
+// Alt-Svc       = clear / 1#alt-value
+// alt-value     = alternative *( OWS ";" OWS parameter )
+// alternative   = protocol-id "=" alt-authority
+// alt-authority = quoted-string ; containing [ uri-host ] ":" port
+type AltSvc struct {
+	ProtocolID string
+	Host       string // empty means the host of the origin
+	Port       string
+	Expires    time.Time
+	Persist    bool
+}
+
+func (altSvc AltSvc) String() string {
+	return fmt.Sprintf("%s=%q; expires=%v", altSvc.ProtocolID, altSvc.Host+":"+altSvc.Port, altSvc.Expires)
+}
+
+// ParseAltSvc parses an Alt-Svc field value.
+// It returns no entries and no error for "clear".
+func ParseAltSvc(fieldValue string, now time.Time) ([]AltSvc, error) {
+	fieldValue = strings.TrimSpace(fieldValue)
+	if fieldValue == "clear" {
+		return nil, nil
+	}
+
+	altSvcs := []AltSvc{}
+	for _, altValue := range splitQuoted(fieldValue, ',') {
+		params := splitQuoted(altValue, ';')
+
+		alternative := strings.SplitN(params[0], "=", 2)
+		if len(alternative) != 2 {
+			return nil, fmt.Errorf("invalid alternative %q", params[0])
+		}
+		protocolID, err := neturl.PathUnescape(strings.TrimSpace(alternative[0]))
+		if err != nil {
+			return nil, err
+		}
+		authority := unquote(alternative[1])
+		i := strings.LastIndex(authority, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid alt-authority %q", authority)
+		}
+
+		altSvc := AltSvc{
+			ProtocolID: protocolID,
+			Host:       authority[:i],
+			Port:       authority[i+1:],
+			Expires:    now.Add(DefaultAltSvcMaxAge),
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key, value := strings.ToLower(strings.TrimSpace(kv[0])), unquote(kv[1])
+			switch key {
+			case "ma":
+				maxAge, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ma %q", value)
+				}
+				altSvc.Expires = now.Add(time.Duration(maxAge) * time.Second)
+			case "persist":
+				altSvc.Persist = value == "1"
+			}
+		}
+		altSvcs = append(altSvcs, altSvc)
+	}
+	return altSvcs, nil
+}
+
+// split s by sep outside of quoted-string, and trim OWS
+func splitQuoted(s string, sep byte) (parts []string) {
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && quoted:
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// unquote removes quotes and quoted-pair escapes of quoted-string
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// AltSvcCache keeps alternative services received in ALTSVC frames by origin.
+// Origins are keyed as URL.Origin() (scheme://host:port).
+type AltSvcCache struct {
+	mu      sync.Mutex
+	entries map[string][]AltSvc
+}
+
+func NewAltSvcCache() *AltSvcCache {
+	return &AltSvcCache{
+		entries: make(map[string][]AltSvc),
+	}
+}
+
+// Update replaces the alternative services of origin with fieldValue.
+// section 3: a new advertisement invalidates the previous ones.
+func (cache *AltSvcCache) Update(origin, fieldValue string) error {
+	altSvcs, err := ParseAltSvc(fieldValue, time.Now())
+	if err != nil {
+		return err
+	}
+	key, err := originKey(origin)
+	if err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(altSvcs) == 0 {
+		logger.Debug("clear alt-svc of %s", key)
+		delete(cache.entries, key)
+		return nil
+	}
+	logger.Debug("alt-svc of %s %v", key, altSvcs)
+	cache.entries[key] = altSvcs
+	return nil
+}
+
+// Lookup returns the alternative services of origin which are still fresh.
+func (cache *AltSvcCache) Lookup(origin string) []AltSvc {
+	key, err := originKey(origin)
+	if err != nil {
+		return nil
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := time.Now()
+	fresh := []AltSvc{}
+	for _, altSvc := range cache.entries[key] {
+		if altSvc.Expires.After(now) {
+			fresh = append(fresh, altSvc)
+		}
+	}
+	if len(fresh) == 0 {
+		delete(cache.entries, key)
+		return nil
+	}
+	cache.entries[key] = fresh
+	return fresh
+}
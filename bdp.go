@@ -0,0 +1,83 @@
+package minimalist_http2
+
+import "time"
+
+// opaque data of PING frames sent to measure round trips, 8 byte
+var bdpPing = []byte("bdp-ping")
+
+// bdpEstimator samples the bytes received during a PING round trip, which is
+// the bandwidth-delay product of the connection unless the receive window
+// limits it. It's used only from ReadLoop.
+type bdpEstimator struct {
+	// receive window in use and the ceiling to grow it
+	window int32
+	max    int32
+	// bytes received since the PING was sent, which is in flight
+	// while sentAt is not zero
+	sample int64
+	sentAt time.Time
+	// smoothed round trip time
+	rtt time.Duration
+	// highest bandwidth seen in byte per second
+	bwMax float64
+}
+
+func newBDPEstimator(window, max int32) *bdpEstimator {
+	return &bdpEstimator{
+		window: window,
+		max:    max,
+	}
+}
+
+// received adds length of DATA to the sample. It returns true
+// when a PING should be sent to start a new sample.
+func (bdp *bdpEstimator) received(length int32) bool {
+	if bdp.window >= bdp.max {
+		return false
+	}
+	if bdp.sentAt.IsZero() {
+		bdp.sentAt = time.Now()
+		bdp.sample = int64(length)
+		return true
+	}
+	bdp.sample += int64(length)
+	return false
+}
+
+// acked ends the sample at PING ACK. It returns the new receive window
+// when the window limited the sample, and 0 when it should not grow.
+func (bdp *bdpEstimator) acked() int32 {
+	if bdp.sentAt.IsZero() {
+		return 0
+	}
+	rtt := time.Since(bdp.sentAt)
+	bdp.sentAt = time.Time{}
+	if bdp.rtt == 0 {
+		bdp.rtt = rtt
+	} else {
+		bdp.rtt = (bdp.rtt*7 + rtt) / 8
+	}
+	if bdp.rtt <= 0 {
+		return 0
+	}
+
+	bw := float64(bdp.sample) / bdp.rtt.Seconds()
+	if bw > bdp.bwMax {
+		bdp.bwMax = bw
+	}
+
+	// the peer sent close to the whole window in a round trip
+	// and the bandwidth is still growing
+	if bdp.sample < int64(bdp.window)*2/3 || bw < bdp.bwMax {
+		return 0
+	}
+	size := bdp.sample * 2
+	if size > int64(bdp.max) {
+		size = int64(bdp.max)
+	}
+	if size <= int64(bdp.window) {
+		return 0
+	}
+	bdp.window = int32(size)
+	return bdp.window
+}
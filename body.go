@@ -1,6 +1,14 @@
 package minimalist_http2
 
-import "bytes"
+import (
+	"bytes"
+	"io"
+	"minimalist-http2/frame"
+	"minimalist-http2/h2"
+	"net/http"
+	"strings"
+	"sync"
+)
 
 type Body struct {
 	bytes.Buffer
@@ -9,3 +17,145 @@ type Body struct {
 func (b *Body) Close() error {
 	return nil
 }
+
+// fillTrailer copies the received trailers into trailer,
+// in the goroutine reading the body when it reaches io.EOF
+func fillTrailer(trailer *http.Header, received http.Header) {
+	if *trailer == nil && len(received) > 0 {
+		*trailer = make(http.Header)
+	}
+	for name, values := range received {
+		(*trailer)[name] = values
+	}
+}
+
+// declaredTrailer returns the fields named in the Trailer header
+// with nil values, until they are received after the body
+func declaredTrailer(header http.Header) http.Header {
+	var trailer http.Header
+	for _, value := range header["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[name] = nil
+		}
+	}
+	return trailer
+}
+
+// Pipe is the body of a stream fed by its DATA frames while
+// the application reads it. Received data is buffered, bounded by
+// the receive window, which is opened again as the data is read.
+type Pipe struct {
+	stream *Stream
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error // returned by Read once buf is drained
+	closed bool  // closed by the application
+	// trailers received on the stream, copied into the request
+	// or response trailer when Read reaches io.EOF
+	received http.Header
+	trailer  *http.Header
+}
+
+func NewPipe(stream *Stream) *Pipe {
+	pipe := &Pipe{
+		stream: stream,
+	}
+	pipe.cond = sync.NewCond(&pipe.mu)
+	return pipe
+}
+
+// write appends data received on the stream,
+// data after the application closed the body is discarded.
+func (pipe *Pipe) write(data []byte) {
+	pipe.mu.Lock()
+	if pipe.closed {
+		pipe.mu.Unlock()
+		pipe.stream.Conn.WindowConsume(int32(len(data)))
+		return
+	}
+	pipe.buf.Write(data)
+	pipe.cond.Signal()
+	pipe.mu.Unlock()
+}
+
+// setTrailer keeps trailers received when the peer ends the stream,
+// until Read returns io.EOF
+func (pipe *Pipe) setTrailer(trailer http.Header) {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+	pipe.received = trailer
+}
+
+// closeWithError makes Read return err after the buffered data,
+// io.EOF when the peer ended the stream.
+func (pipe *Pipe) closeWithError(err error) {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+	if pipe.err == nil {
+		pipe.err = err
+	}
+	pipe.cond.Broadcast()
+}
+
+func (pipe *Pipe) Read(p []byte) (n int, err error) {
+	pipe.mu.Lock()
+	for pipe.buf.Len() == 0 && pipe.err == nil {
+		pipe.cond.Wait()
+	}
+	if pipe.buf.Len() == 0 {
+		err = pipe.err
+		if err == io.EOF && pipe.trailer != nil {
+			fillTrailer(pipe.trailer, pipe.received)
+			pipe.trailer = nil
+		}
+		pipe.mu.Unlock()
+		return 0, err
+	}
+	n, _ = pipe.buf.Read(p)
+	ended := pipe.err != nil
+	pipe.mu.Unlock()
+
+	// no more WINDOW_UPDATE for the stream once the peer ended it
+	pipe.stream.consume(int32(n), !ended)
+	return n, nil
+}
+
+// Close discards the unread data, and cancels the stream with RST_STREAM
+// when either endpoint has not ended it yet, section 8.1 of RFC 9113.
+func (pipe *Pipe) Close() error {
+	return pipe.cancel(h2.CANCEL_ERROR)
+}
+
+// cancel closes the pipe with RST_STREAM of code
+func (pipe *Pipe) cancel(code h2.ErrCode) error {
+	pipe.mu.Lock()
+	if pipe.closed {
+		pipe.mu.Unlock()
+		return nil
+	}
+	pipe.closed = true
+	unread := pipe.buf.Len()
+	pipe.buf.Reset()
+	ended := pipe.err != nil
+	if !ended {
+		pipe.err = ErrBodyClosed
+	}
+	pipe.cond.Broadcast()
+	pipe.mu.Unlock()
+
+	pipe.stream.Conn.WindowConsume(int32(unread))
+	// a request body still being sent is abandoned
+	if !ended || pipe.stream.state() != CLOSED {
+		pipe.stream.Write(frame.NewRstStreamFrame(pipe.stream.ID, code))
+		pipe.stream.Close()
+	}
+	return nil
+}
@@ -1,111 +1,453 @@
 package minimalist_http2
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/Jxck/color"
 	"github.com/Jxck/logger"
 	"io"
 	"log"
 	"minimalist-http2/frame"
+	"minimalist-http2/h2"
 	"minimalist-http2/hpack"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// section 5.1.1 largest stream identifier
+const MAX_STREAM_ID uint32 = 1<<31 - 1
+
 // A transport-layer connection between tow endpoints
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
 type Connection struct {
-	RW           io.ReadWriter
-	HPackContext *hpack.Context
+	mu sync.Mutex
+	RW io.ReadWriter
+	// encodes header blocks to the peer, the table is bounded
+	// by SETTINGS_HEADER_TABLE_SIZE of the peer
+	Encoder *hpack.Encoder
+	// decodes header blocks from the peer, the table is bounded
+	// by SETTINGS_HEADER_TABLE_SIZE of this endpoint
+	Decoder      *hpack.Decoder
 	LastStreamID uint32
 	Window       *Window
 	Settings     map[frame.SettingsID]int32
 	PeerSettings map[frame.SettingsID]int32
 	Streams      map[uint32]*Stream
-	WriteChan    chan frame.Frame
-	CallBack     func(stream *Stream)
+	// orders frames for WriteLoop by type and the priority of streams
+	scheduler *writeScheduler
+	// called for streams opened by the peer
+	CallBack CallBack
+	// called with ALTSVC frames received from the server (RFC 7838)
+	AltSvcCallBack func(streamID uint32, origin, fieldValue string)
+	// called with frames of extension types other than ALTSVC and ORIGIN,
+	// types added by frame.RegisterFrameType and UnknownFrame for the others
+	ExtensionCallBack func(f frame.Frame)
+	// origin the client opened the connection for, as URL.Origin()
+	Origin string
+	// origins the server is authoritative for, from ORIGIN frames (RFC 8336)
+	// nil until the first ORIGIN frame is received
+	originSet map[string]bool
+	// next ID of streams opened by this endpoint, odd for clients and
+	// even for servers, which open streams only for server push
+	nextStreamID uint32
+	// held while a stream is opened, for the peer must see
+	// new stream IDs in increasing order
+	openMu sync.Mutex
+	// streams opened by this endpoint and not finished yet,
+	// limited by SETTINGS_MAX_CONCURRENT_STREAMS of the peer
+	activeStreams int
+	idleSince     time.Time
+	// no new stream is opened after GOAWAY or once the connection is broken
+	goingAway bool
+	closed    chan struct{}
+	closeOnce sync.Once
+	// held by WriteLoop while it has a frame, so Close does not cut it
+	writeMu sync.Mutex
+	// held while a header block is encoded and queued,
+	// so blocks are sent in the order of the encoder
+	headerMu sync.Mutex
+	// HEADERS or PUSH_PROMISE frame waiting for CONTINUATION frames,
+	// with the header block received so far
+	headerBlockFrame frame.Frame
+	headerBlock      []byte
+	// estimates the bandwidth-delay product to grow the receive windows,
+	// nil unless auto-tuning is enabled
+	bdp *bdpEstimator
 }
 
 func NewConnection(rw io.ReadWriter) *Connection {
-	return &Connection{
+	conn := &Connection{
 		RW:           rw,
-		HPackContext: hpack.NewContext(uint32(frame.DEFAULT_HEADER_TABLE_SIZE)),
+		Encoder:      hpack.NewEncoder(uint32(frame.DEFAULT_HEADER_TABLE_SIZE)),
+		Decoder:      hpack.NewDecoder(uint32(DefaultSettings[frame.SETTINGS_HEADER_TABLE_SIZE])),
 		Window:       NewDefaultWindow(),
-		Settings:     DefaultSettings,
-		PeerSettings: DefaultSettings,
+		Settings:     CopySettings(DefaultSettings),
+		PeerSettings: CopySettings(DefaultSettings),
 		Streams:      make(map[uint32]*Stream),
-		WriteChan:    make(chan frame.Frame),
+		scheduler:    newWriteScheduler(),
+		nextStreamID: 1,
+		idleSince:    time.Now(),
+		closed:       make(chan struct{}),
 	}
+	conn.Decoder.MaxHeaderListSize = uint32(conn.Settings[frame.SETTINGS_MAX_HEADER_LIST_SIZE])
+	return conn
+}
+
+// SetMaxHeaderListSize limits the size of header lists from the peer,
+// which is advertised in SETTINGS_MAX_HEADER_LIST_SIZE.
+// It's called before SETTINGS are sent.
+func (conn *Connection) SetMaxHeaderListSize(size int32) {
+	conn.Settings[frame.SETTINGS_MAX_HEADER_LIST_SIZE] = size
+	conn.Decoder.MaxHeaderListSize = uint32(size)
 }
 
-func (conn *Connection) NewStream(streamID uint32) *Stream {
+// EnableWindowAutoTuning grows the receive windows of the connection and
+// its streams up to max, when PING round trips show they limit throughput.
+// It's called before SETTINGS are sent.
+func (conn *Connection) EnableWindowAutoTuning(max int32) {
+	if int64(max) > MAX_WINDOW_SIZE || max < 0 {
+		max = int32(MAX_WINDOW_SIZE)
+	}
+	conn.bdp = newBDPEstimator(conn.Settings[frame.SETTINGS_INITIAL_WINDOW_SIZE], max)
+}
+
+// NewServerConnection is NewConnection for the server side,
+// where only pushed streams get an ID of this endpoint.
+func NewServerConnection(rw io.ReadWriter) *Connection {
+	conn := NewConnection(rw)
+	conn.nextStreamID = 2
+	return conn
+}
+
+// NewStream creates a stream which calls callback when the peer ends it,
+// and registers it to the connection.
+func (conn *Connection) NewStream(streamID uint32, callback CallBack) *Stream {
+	stream := NewStream(conn, streamID, callback)
+	conn.scheduler.open(streamID)
+
+	conn.mu.Lock()
 	logger.Debug("adding new stream (id=%d) total (%d)", streamID, len(conn.Streams))
+	conn.Streams[streamID] = stream
+	closed := conn.isClosed()
+	conn.mu.Unlock()
 
-	return NewStream(
-		streamID,
-		conn.WriteChan,
-		conn.Settings,
-		conn.PeerSettings,
-		conn.HPackContext,
-		conn.CallBack)
+	// a broken connection never completes the stream
+	if closed {
+		stream.Reset(ErrConnectionClosed)
+	}
+	return stream
 }
 
-func (conn *Connection) HandleSettings(settingsFrame *frame.SettingsFrame) {
-	if settingsFrame.Flags == frame.PING_ACK {
-		logger.Trace("receive SETTINGS ack")
-		return
+// OpenStream creates a stream with the next stream ID of this endpoint and
+// sends header on it, which ends the stream when endStream is true. The
+// response body is streamed into Body and callback is called at its HEADERS.
+// It returns ErrStreamIDExhausted when no stream ID is left on the connection.
+func (conn *Connection) OpenStream(callback CallBack, header http.Header, endStream bool) (*Stream, error) {
+	conn.openMu.Lock()
+	defer conn.openMu.Unlock()
+
+	streamID, err := conn.allocStreamID()
+	if err != nil {
+		return nil, err
 	}
+	stream := conn.NewStream(streamID, callback)
+	stream.Body = NewPipe(stream)
+	stream.Origin = requestOrigin(header)
+	stream.WriteHeaders(header, endStream)
+	return stream, nil
+}
 
-	if settingsFrame.Flags != frame.UNSET {
-		logger.Error("unknown flag of SETTINGS Frame %v", settingsFrame.Flags)
-		return
+// section 5.1.1
+// Stream identifiers cannot be reused. When they are exhausted,
+// no new stream can be opened and a new connection is needed.
+func (conn *Connection) allocStreamID() (uint32, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	streamID := conn.nextStreamID
+	if streamID > MAX_STREAM_ID {
+		conn.goingAway = true
+		return 0, ErrStreamIDExhausted
+	}
+	conn.nextStreamID += 2
+	if conn.nextStreamID > MAX_STREAM_ID {
+		logger.Info("stream id exhausted by stream(%d)", streamID)
+		conn.goingAway = true
+	}
+	return streamID, nil
+}
+
+// section 5.1.1
+// Stream IDs of this endpoint not opened yet are idle,
+// and lower IDs not in Streams anymore are closed.
+func (conn *Connection) isLocalStreamID(streamID uint32) (local, idle bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if streamID%2 != conn.nextStreamID%2 {
+		return false, false
+	}
+	return true, streamID >= conn.nextStreamID
+}
+
+// Stream returns the registered stream of streamID
+func (conn *Connection) Stream(streamID uint32) (*Stream, bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	stream, ok := conn.Streams[streamID]
+	return stream, ok
+}
+
+// section 6.8
+// Streams of this endpoint above the last stream identifier of GOAWAY
+// were not processed by the peer, so they are reset as REFUSED_STREAM
+// and can be retried on another connection.
+func (conn *Connection) refuseStreamsAfter(lastStreamID uint32) {
+	for _, stream := range conn.streams() {
+		streamID := stream.ID
+		local, _ := conn.isLocalStreamID(streamID)
+		if local && streamID > lastStreamID {
+			stream.Reset(h2.StreamError{StreamID: streamID, Code: h2.REFUSED_STREAM_ERROR})
+		}
+	}
+}
+
+// streams returns a snapshot of Streams, so they can be
+// closed without holding conn.mu while they remove themselves
+func (conn *Connection) streams() []*Stream {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	streams := make([]*Stream, 0, len(conn.Streams))
+	for _, stream := range conn.Streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (conn *Connection) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *Connection) removeStream(streamID uint32) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	logger.Info("remove stream(%d) from conn.Streams[]", streamID)
+	delete(conn.Streams, streamID)
+	conn.scheduler.remove(streamID)
+}
+
+// HandleSettings applies SETTINGS of the peer and acknowledges them.
+// It returns the connection error for invalid values.
+func (conn *Connection) HandleSettings(settingsFrame *frame.SettingsFrame) *h2.H2Error {
+	// section 4.1 unknown flags are ignored
+	if settingsFrame.Flags.Has(frame.SETTINGS_ACK) {
+		logger.Trace("receive SETTINGS ack")
+		return nil
 	}
 
 	// received SETTINGS frame
 	settings := settingsFrame.Settings
 
-	defaultSettings := map[frame.SettingsID]int32{
-		frame.SETTINGS_HEADER_TABLE_SIZE:      frame.DEFAULT_HEADER_TABLE_SIZE,
-		frame.SETTINGS_ENABLE_PUSH:            frame.DEFAULT_ENABLE_PUSH,
-		frame.SETTINGS_MAX_CONCURRENT_STREAMS: frame.DEFAULT_MAX_CONCURRENT_STREAMS,
-		frame.SETTINGS_INITIAL_WINDOW_SIZE:    frame.DEFAULT_INITIAL_WINDOW_SIZE,
-		frame.SETTINGS_MAX_FRAME_SIZE:         frame.DEFAULT_MAX_FRAME_SIZE,
-		frame.SETTINGS_MAX_HEADER_LIST_SIZE:   frame.DEFAULT_MAX_HEADER_LIST_SIZE,
+	initialWindowSize, ok := settings[frame.SETTINGS_INITIAL_WINDOW_SIZE]
+	if ok && initialWindowSize < 0 { // validate < 2^31-1
+		msg := "SETTINGS_INITIAL_WINDOW_SIZE too large"
+		logger.Error("FLOW_CONTROL_ERROR (%s)", msg)
+		return &h2.H2Error{ErrCode: h2.FLOW_CONTROL_ERROR, AdditionalDebugData: msg}
+	}
+
+	// section 6.5.2
+	if maxFrameSize, ok := settings[frame.SETTINGS_MAX_FRAME_SIZE]; ok &&
+		(maxFrameSize < frame.DEFAULT_MAX_FRAME_SIZE || maxFrameSize > frame.MAX_FRAME_SIZE_LIMIT) {
+		msg := fmt.Sprintf("invalid SETTINGS_MAX_FRAME_SIZE %d", maxFrameSize)
+		logger.Error("PROTOCOL_ERROR (%s)", msg)
+		return &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg}
+	}
+	if enablePush, ok := settings[frame.SETTINGS_ENABLE_PUSH]; ok && enablePush != 0 && enablePush != 1 {
+		msg := fmt.Sprintf("invalid SETTINGS_ENABLE_PUSH %d", enablePush)
+		logger.Error("PROTOCOL_ERROR (%s)", msg)
+		return &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg}
 	}
 
+	// merge into settings of the peer
+	conn.mu.Lock()
 	for k, v := range settings {
-		defaultSettings[k] = v
+		conn.PeerSettings[k] = v
 	}
+	conn.mu.Unlock()
 
 	logger.Trace("merged settings==================")
-
-	for k, v := range defaultSettings {
+	for k, v := range conn.PeerSettings {
 		logger.Trace("%v:%v", k, v)
 	}
 
-	// save settings to conn
-	conn.Settings = settings
+	// the encoder signals the new size in the next header block
+	if headerTableSize, ok := settings[frame.SETTINGS_HEADER_TABLE_SIZE]; ok && headerTableSize >= 0 {
+		conn.Encoder.SetMaxDynamicTableSize(uint32(headerTableSize))
+	}
 
-	initialWindowSize, ok := settings[frame.SETTINGS_INITIAL_WINDOW_SIZE]
 	if ok {
-		if initialWindowSize > 2147483647 { // validate < 2^31-1
-			logger.Error("FLOW_CONTROL_ERROR (%s)", "SETTINGS_INITIAL_WINDOW_SIZE too large")
+		for _, stream := range conn.streams() {
+			if !stream.Window.UpdateInitialSize(initialWindowSize) {
+				msg := goAwayFlowError{}.Error()
+				logger.Error("FLOW_CONTROL_ERROR (%s)", msg)
+				return &h2.H2Error{ErrCode: h2.FLOW_CONTROL_ERROR, AdditionalDebugData: msg}
+			}
+		}
+	}
+
+	// send ack
+	ack := frame.NewSettingsFrame(frame.SETTINGS_ACK, 0, NilSettings)
+	conn.WriteFrame(ack)
+	return nil
+}
+
+// Setting returns the value of id in SETTINGS of this endpoint
+func (conn *Connection) Setting(id frame.SettingsID) int32 {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.Settings[id]
+}
+
+// PeerSetting returns the value of id in SETTINGS of the peer
+func (conn *Connection) PeerSetting(id frame.SettingsID) int32 {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.PeerSettings[id]
+}
+
+// ReserveStream counts a new stream opened by this endpoint against
+// SETTINGS_MAX_CONCURRENT_STREAMS of the peer. It returns false when
+// the connection is going away or there is no room for another stream.
+func (conn *Connection) ReserveStream() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.goingAway {
+		return false
+	}
+	if conn.activeStreams >= int(conn.PeerSettings[frame.SETTINGS_MAX_CONCURRENT_STREAMS]) {
+		return false
+	}
+	conn.activeStreams++
+	return true
+}
+
+// ReleaseStream ends a stream counted by ReserveStream
+// and reports whether the connection became idle.
+func (conn *Connection) ReleaseStream() (idle bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.activeStreams--
+	if conn.activeStreams > 0 {
+		return false
+	}
+	conn.idleSince = time.Now()
+	return true
+}
+
+// GoingAway reports whether no new stream can be opened on the connection
+func (conn *Connection) GoingAway() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.goingAway
+}
+
+// RetireIfIdle stops new streams on the connection when
+// it has had no active stream for timeout, and reports whether it did.
+func (conn *Connection) RetireIfIdle(timeout time.Duration) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.activeStreams > 0 || time.Since(conn.idleSince) < timeout {
+		return false
+	}
+	conn.goingAway = true
+	return true
+}
+
+func (conn *Connection) markGoingAway() {
+	conn.mu.Lock()
+	conn.goingAway = true
+	conn.mu.Unlock()
+}
+
+// RFC 7838 section 4
+// An ALTSVC frame on stream 0 with empty (length 0) "Origin" information
+// is invalid and MUST be ignored. An ALTSVC frame on a stream other than
+// stream 0 containing non-empty "Origin" information is invalid and MUST be ignored.
+func (conn *Connection) HandleAltSvc(altSvcFrame *frame.AltSvcFrame) {
+	streamID := altSvcFrame.StreamID
+	origin := altSvcFrame.Origin
+	if (streamID == 0) == (origin == "") {
+		logger.Debug("ignore invalid ALTSVC frame (stream=%d, origin=%q)", streamID, origin)
+		return
+	}
+	if conn.AltSvcCallBack == nil {
+		return
+	}
+	// the alternative on a stream is for the origin of its request
+	if streamID != 0 {
+		stream, ok := conn.Stream(streamID)
+		if !ok || stream.Origin == "" {
+			logger.Debug("ignore ALTSVC frame for unknown origin of stream(%d)", streamID)
 			return
 		}
-		conn.PeerSettings[frame.SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+		origin = stream.Origin
+	}
+	conn.AltSvcCallBack(streamID, origin, altSvcFrame.FieldValue)
+}
 
-		for _, stream := range conn.Streams {
-			log.Println("apply settings to stream", stream)
-			stream.Window.UpdateInitialSize(initialWindowSize)
-			stream.PeerSettings[frame.SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+// handleExtension passes a frame of an extension type to its handler.
+// section 4.1 unknown types are ignored unless ExtensionCallBack takes them.
+func (conn *Connection) handleExtension(f frame.Frame) {
+	switch fr := f.(type) {
+	case *frame.AltSvcFrame:
+		conn.HandleAltSvc(fr)
+	case *frame.OriginFrame:
+		conn.HandleOrigin(fr)
+	default:
+		if conn.ExtensionCallBack != nil {
+			conn.ExtensionCallBack(f)
 		}
 	}
+}
 
-	// send ack
-	ack := frame.NewSettingsFrame(frame.PING_ACK, 0, NilSettings)
-	conn.WriteChan <- ack
+// RFC 8336 section 2.3
+// The ORIGIN frame replaces the origin set of the connection,
+// which always contains the origin the connection was opened for.
+// ORIGIN frames on other streams than 0 or received by servers are ignored.
+func (conn *Connection) HandleOrigin(originFrame *frame.OriginFrame) {
+	if originFrame.StreamID != 0 || conn.Origin == "" {
+		logger.Debug("ignore ORIGIN frame (stream=%d)", originFrame.StreamID)
+		return
+	}
+
+	originSet := map[string]bool{conn.Origin: true}
+	for _, origin := range originFrame.Origins {
+		key, err := originKey(origin)
+		if err != nil {
+			logger.Debug("ignore invalid origin %q: %v", origin, err)
+			continue
+		}
+		originSet[key] = true
+	}
+
+	conn.mu.Lock()
+	conn.originSet = originSet
+	conn.mu.Unlock()
+}
+
+// InOriginSet reports whether the server sent origin in ORIGIN frame
+func (conn *Connection) InOriginSet(origin string) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.originSet[origin]
 }
 
 func (conn *Connection) ReadLoop() {
@@ -114,9 +456,23 @@ func (conn *Connection) ReadLoop() {
 		fr, err := frame.ReadFrame(conn.RW, conn.Settings)
 		if err != nil {
 			logger.Error("connection.ReadLoop error,err: %v", err)
-			h2Error, ok := err.(*H2Error)
-			if ok {
-				conn.GoAway(0, h2Error)
+			switch e := err.(type) {
+			case h2.StreamError:
+				// only the stream is affected, keep reading.
+				// skipped DATA still counts against the connection window
+				if fr.Header().Type == frame.DataFrameType && !conn.Window.Receive(int32(fr.Header().Length)) {
+					msg := "DATA Frame over the connection window"
+					logger.Error("%v", msg)
+					conn.GoAway(0, &h2.H2Error{ErrCode: h2.FLOW_CONTROL_ERROR, AdditionalDebugData: msg})
+					break
+				}
+				conn.discard(fr)
+				conn.WriteFrame(frame.NewRstStreamFrame(e.StreamID, e.Code))
+				continue
+			case h2.ConnectionError:
+				conn.GoAway(0, &h2.H2Error{ErrCode: h2.ErrCode(e), AdditionalDebugData: e.Error()})
+			case *h2.H2Error:
+				conn.GoAway(0, e)
 			}
 			break
 		}
@@ -124,6 +480,35 @@ func (conn *Connection) ReadLoop() {
 			logger.Notice("%v %v", color.Green("recv"), util.Indent(fr.String()))
 		}
 
+		// section 6.10 a header block split into CONTINUATION frames
+		// is passed on once it is complete
+		fr, err = conn.assembleHeaderBlock(fr)
+		if err != nil {
+			logger.Error("%v", err)
+			conn.GoAway(0, err.(*h2.H2Error))
+			break
+		}
+		if fr == nil {
+			continue
+		}
+
+		// header block is decoded in order of frames, even for
+		// closed streams, for the decoder is shared by all streams
+		err = conn.decodeHeaderBlock(fr)
+		headerListTooLarge := err == hpack.ErrHeaderListSize
+		if err != nil && !headerListTooLarge {
+			logger.Error("%v", err)
+			conn.GoAway(0, &h2.H2Error{ErrCode: h2.COMPRESSION_ERROR, AdditionalDebugData: err.Error()})
+			break
+		}
+
+		// section 5.5 extension frames do not affect stream state
+		// or flow control on any stream
+		if fr.Header().Type.IsExtension() {
+			conn.handleExtension(fr)
+			continue
+		}
+
 		streamID := fr.Header().StreamID
 		types := fr.Header().Type
 
@@ -137,7 +522,7 @@ func (conn *Connection) ReadLoop() {
 
 				msg := fmt.Sprintf("%s Frame for stream ID 0", types)
 				logger.Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
+				conn.GoAway(0, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg})
 				break
 			}
 
@@ -147,7 +532,10 @@ func (conn *Connection) ReadLoop() {
 					logger.Error("invalid settings frame %v", fr)
 					return
 				}
-				conn.HandleSettings(settingsFrame)
+				if h2Error := conn.HandleSettings(settingsFrame); h2Error != nil {
+					conn.GoAway(0, h2Error)
+					break
+				}
 			}
 
 			if types == frame.WindowUpdateFrameType {
@@ -156,21 +544,42 @@ func (conn *Connection) ReadLoop() {
 					logger.Error("invalid window update frame %v", fr)
 					return
 				}
-				logger.Debug("connection window size increment(%v)", int32(windowUpdateFrame.WindowSizeIncrement))
-				conn.Window.UpdatePeer(int32(windowUpdateFrame.WindowSizeIncrement))
+				increment := int32(windowUpdateFrame.WindowSizeIncrement)
+				logger.Debug("connection window size increment(%v)", increment)
+
+				// section 6.9 and 6.9.1
+				if increment == 0 {
+					msg := "WINDOW_UPDATE with 0 increment"
+					logger.Error("%v", msg)
+					conn.GoAway(0, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg})
+					break
+				}
+				if !conn.Window.UpdatePeer(increment) {
+					msg := goAwayFlowError{}.Error()
+					logger.Error("%v", msg)
+					conn.GoAway(0, &h2.H2Error{ErrCode: h2.FLOW_CONTROL_ERROR, AdditionalDebugData: msg})
+					break
+				}
 			}
 
 			// respond to PING
 			if types == frame.PingFrameType {
+				pingFrame := fr.(*frame.PingFrame)
 				if fr.Header().Flags != frame.PING_ACK {
-					conn.PingACK([]byte("pong    ")) // 8 byte
+					conn.PingACK(pingFrame.OpaqueData)
+				} else if conn.bdp != nil && bytes.Equal(pingFrame.OpaqueData, bdpPing) {
+					conn.growWindow(conn.bdp.acked())
 				}
 				continue
 			}
 
+			// streams in flight are still served,
+			// the peer closes the connection when it's done
 			if types == frame.GoAwayFrameType {
-				logger.Debug("stop conn.ReadLoop() by GOAWAY")
-				break
+				logger.Debug("no more stream on the connection by GOAWAY")
+				conn.markGoingAway()
+				conn.refuseStreamsAfter(fr.(*frame.GoAwayFrame).LastStreamID)
+				continue
 			}
 		}
 		if streamID > 0 {
@@ -179,74 +588,361 @@ func (conn *Connection) ReadLoop() {
 				types == frame.GoAwayFrameType {
 				msg := fmt.Sprintf("%s Frame for stream Id not 0", types)
 				logger.Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
+				conn.GoAway(0, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg})
 				break
 			}
 
-			if types == frame.DataFrameType {
-				length := int32(fr.Header().Length)
-				conn.WindowConsume(length)
+			// section 6.9.1 the peer must not send more than the window
+			if types == frame.DataFrameType && !conn.Window.Receive(int32(fr.Header().Length)) {
+				msg := "DATA Frame over the connection window"
+				logger.Error("%v", msg)
+				conn.GoAway(0, &h2.H2Error{ErrCode: h2.FLOW_CONTROL_ERROR, AdditionalDebugData: msg})
+				break
+			}
+			if types == frame.DataFrameType && conn.bdp != nil && conn.bdp.received(int32(fr.Header().Length)) {
+				conn.WriteFrame(frame.NewPingFrame(frame.UNSET, 0, bdpPing))
+			}
+
+			// section 5.3 priority applies to streams in any state
+			if priority := priorityOf(fr); priority != nil {
+				if priority.StreamDependency == streamID {
+					logger.Error("stream(%d) depends on itself", streamID)
+					conn.WriteFrame(frame.NewRstStreamFrame(streamID, h2.PROTOCOL_ERROR))
+					if stream, ok := conn.Stream(streamID); ok {
+						stream.Reset(h2.StreamError{StreamID: streamID, Code: h2.PROTOCOL_ERROR})
+					}
+					continue
+				}
+				conn.scheduler.prioritize(streamID, priority)
 			}
 
-			stream, ok := conn.Streams[streamID]
+			stream, ok := conn.Stream(streamID)
 			if !ok {
-				stream = conn.NewStream(streamID)
-				conn.Streams[streamID] = stream
+				local, idle := conn.isLocalStreamID(streamID)
+				if local && idle {
+					msg := fmt.Sprintf("%s Frame for idle stream(%d)", types, streamID)
+					logger.Error("%v", msg)
+					conn.GoAway(0, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg})
+					break
+				}
+
+				// section 5.1 closed
+				// WINDOW_UPDATE, PRIORITY or RST_STREAM can arrive
+				// for a short period after the stream is closed
+				if local || streamID <= conn.LastStreamID {
+					conn.discard(fr)
+					if types != frame.WindowUpdateFrameType &&
+						types != frame.PriorityFrameType &&
+						types != frame.RstStreamFrameType {
+						logger.Error("%s Frame for closed stream(%d)", types, streamID)
+						conn.WriteFrame(frame.NewRstStreamFrame(streamID, h2.STREAM_CLOSED_ERROR))
+					}
+					continue
+				}
+
+				// section 5.1 idle
+				// only HEADERS opens a stream of the peer,
+				// PRIORITY has been applied to the scheduler above
+				if types == frame.PriorityFrameType {
+					continue
+				}
+				if types != frame.HeadersFrameType {
+					msg := fmt.Sprintf("%s Frame for idle stream(%d)", types, streamID)
+					logger.Error("%v", msg)
+					conn.GoAway(0, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg})
+					break
+				}
+
+				// the request body is streamed to the handler
+				stream = conn.NewStream(streamID, conn.CallBack)
+				stream.Body = NewPipe(stream)
 
 				if streamID > conn.LastStreamID {
 					conn.LastStreamID = streamID
 				}
 			}
 
+			// frames in flight after this endpoint closed the stream
+			if stream.isClosed() {
+				conn.discard(fr)
+				continue
+			}
+
+			if types == frame.DataFrameType && !stream.Window.Receive(int32(fr.Header().Length)) {
+				logger.Error("DATA Frame over the window of stream(%d)", streamID)
+				conn.discard(fr)
+				conn.WriteFrame(frame.NewRstStreamFrame(streamID, h2.FLOW_CONTROL_ERROR))
+				stream.Reset(h2.StreamError{StreamID: streamID, Code: h2.FLOW_CONTROL_ERROR})
+				continue
+			}
+
+			opening := stream.state() == IDLE
+
 			err = stream.ChangeState(fr, RECV)
 			if err != nil {
 				logger.Error("%v", err)
-				h2Error, ok := err.(*H2Error)
+				h2Error, ok := err.(*h2.H2Error)
 				if ok {
 					conn.GoAway(0, h2Error)
 				}
 				break
 			}
 
-			if stream.State == CLOSED {
-				go func(streamID uint32) {
-					<-time.After(1 * time.Second)
-					logger.Info("remove stream(%d) from conn.Streams[]", streamID)
-					conn.Streams[streamID] = nil
-				}(streamID)
+			// the send window grows even while the stream is busy
+			if windowUpdateFrame, ok := fr.(*frame.WindowUpdateFrame); ok {
+				conn.updateStreamWindow(stream, windowUpdateFrame)
+				continue
 			}
-			stream.ReadChan <- fr
+
+			if headerListTooLarge {
+				conn.refuseHeaderList(stream, opening)
+				continue
+			}
+
+			stream.receive(fr)
 		}
 	}
+	conn.markGoingAway()
 	logger.Debug("stop the readLoop")
 }
 
-func (conn *Connection) WriteLoop() error {
-	logger.Debug("start connection.WriteLoop")
-	for frame := range conn.WriteChan {
-		logger.Notice("%v %v", color.Red("send"), util.Indent(frame.String()))
+// priorityOf returns the priority in HEADERS or PRIORITY frame f,
+// nil for the other frames
+func priorityOf(f frame.Frame) *frame.DependencyTree {
+	switch fr := f.(type) {
+	case *frame.HeadersFrame:
+		if fr.Flags.Has(frame.HEADERS_PRIORITY) {
+			return fr.DependencyTree
+		}
+	case *frame.PriorityFrame:
+		return &frame.DependencyTree{
+			Exclusive:        fr.Exclusive,
+			StreamDependency: fr.StreamDependency,
+			Weight:           fr.Weight,
+		}
+	}
+	return nil
+}
+
+// assembleHeaderBlock buffers the header block of a HEADERS or PUSH_PROMISE
+// frame without END_HEADERS, and returns the frame with the whole block at
+// the last CONTINUATION. It returns nil while the block is not complete.
+// Any other frame in between is a PROTOCOL_ERROR.
+func (conn *Connection) assembleHeaderBlock(f frame.Frame) (frame.Frame, error) {
+	header := f.Header()
+
+	if conn.headerBlockFrame != nil {
+		continuation, ok := f.(*frame.ContinuationFrame)
+		streamID := conn.headerBlockFrame.Header().StreamID
+		if !ok || header.StreamID != streamID {
+			msg := fmt.Sprintf("%s Frame in header block of stream(%d)", header.Type, streamID)
+			return nil, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg}
+		}
+		// the whole block is buffered before it's decoded,
+		// so the header list limit does not bound it
+		if len(conn.headerBlock)+len(continuation.HeaderBlockFragment) > conn.maxHeaderBlockSize() {
+			msg := fmt.Sprintf("header block of stream(%d) too large", streamID)
+			return nil, &h2.H2Error{ErrCode: h2.ENHANCE_YOUR_CALM_ERROR, AdditionalDebugData: msg}
+		}
+		conn.headerBlock = append(conn.headerBlock, continuation.HeaderBlockFragment...)
+		if !header.Flags.Has(frame.CONTINUAION_END_HEADERS) {
+			return nil, nil
+		}
+
+		f, headerBlock := conn.headerBlockFrame, conn.headerBlock
+		conn.headerBlockFrame, conn.headerBlock = nil, nil
+		switch fr := f.(type) {
+		case *frame.HeadersFrame:
+			fr.HeaderBlockFragment = headerBlock
+			fr.Flags |= frame.HEADERS_END_HEADERS
+		case *frame.PushPromiseFrame:
+			fr.HeaderBlockFragment = headerBlock
+			fr.Flags |= frame.PUSH_PROMISE_END_HEADERS
+		}
+		return f, nil
+	}
 
-		err := frame.Write(conn.RW)
+	switch fr := f.(type) {
+	case *frame.ContinuationFrame:
+		msg := fmt.Sprintf("CONTINUATION Frame without header block on stream(%d)", header.StreamID)
+		return nil, &h2.H2Error{ErrCode: h2.PROTOCOL_ERROR, AdditionalDebugData: msg}
+	case *frame.HeadersFrame:
+		if !header.Flags.Has(frame.HEADERS_END_HEADERS) && header.StreamID != 0 {
+			conn.headerBlockFrame = fr
+			conn.headerBlock = append([]byte(nil), fr.HeaderBlockFragment...)
+			return nil, nil
+		}
+	case *frame.PushPromiseFrame:
+		if !header.Flags.Has(frame.PUSH_PROMISE_END_HEADERS) && header.StreamID != 0 {
+			conn.headerBlockFrame = fr
+			conn.headerBlock = append([]byte(nil), fr.HeaderBlockFragment...)
+			return nil, nil
+		}
+	}
+	return f, nil
+}
+
+// maxHeaderBlockSize bounds a header block assembled from CONTINUATION
+// frames, which is the header list limit with a frame of slack, so a list
+// a little too large is still decoded and refused with the stream only
+func (conn *Connection) maxHeaderBlockSize() int {
+	limit := int(conn.Decoder.MaxHeaderListSize)
+	if limit == 0 {
+		limit = int(DefaultMaxHeaderListSize)
+	}
+	return limit + frame.DEFAULT_MAX_FRAME_SIZE
+}
+
+// updateStreamWindow applies WINDOW_UPDATE of a stream, section 6.9 and
+// 6.9.1, a 0 increment or an overflow of the window ends only the stream
+func (conn *Connection) updateStreamWindow(stream *Stream, f *frame.WindowUpdateFrame) {
+	increment := int32(f.WindowSizeIncrement)
+	logger.Debug("stream(%d) window size increment(%v)", stream.ID, increment)
+
+	code := h2.NO_ERROR
+	if increment == 0 {
+		code = h2.PROTOCOL_ERROR
+	} else if !stream.Window.UpdatePeer(increment) {
+		code = h2.FLOW_CONTROL_ERROR
+	}
+	if code == h2.NO_ERROR {
+		return
+	}
+
+	logger.Error("invalid WINDOW_UPDATE of stream(%d): %v", stream.ID, code)
+	conn.WriteFrame(frame.NewRstStreamFrame(stream.ID, code))
+	stream.Reset(h2.StreamError{StreamID: stream.ID, Code: code})
+}
+
+// refuseHeaderList answers HEADERS over SETTINGS_MAX_HEADER_LIST_SIZE,
+// with 431 when they open a stream of the peer, and resets the stream otherwise
+func (conn *Connection) refuseHeaderList(stream *Stream, opening bool) {
+	logger.Error("header list of stream(%d) over %d", stream.ID, conn.Decoder.MaxHeaderListSize)
+
+	if local, _ := conn.isLocalStreamID(stream.ID); opening && !local {
+		status := http.StatusRequestHeaderFieldsTooLarge
+		stream.WriteHeaders(http.Header{":status": {strconv.Itoa(status)}}, true)
+		// the request is not read any more, section 8.1
+		stream.Write(frame.NewRstStreamFrame(stream.ID, h2.NO_ERROR))
+		return
+	}
+
+	conn.WriteFrame(frame.NewRstStreamFrame(stream.ID, h2.PROTOCOL_ERROR))
+	stream.Reset(h2.StreamError{StreamID: stream.ID, Code: h2.PROTOCOL_ERROR})
+}
+
+// decodeHeaderBlock decodes the header block of HEADERS into Headers,
+// and of PUSH_PROMISE only to keep the dynamic table in sync
+func (conn *Connection) decodeHeaderBlock(f frame.Frame) error {
+	switch fr := f.(type) {
+	case *frame.HeadersFrame:
+		headerList, err := conn.Decoder.Decode(fr.HeaderBlockFragment)
 		if err != nil {
-			logger.Error("connection frame.Write error, err: %v", err)
 			return err
 		}
+		fr.Headers = headerList.ToHeader()
+	case *frame.PushPromiseFrame:
+		_, err := conn.Decoder.Decode(fr.HeaderBlockFragment)
+		return err
 	}
 	return nil
 }
 
+func (conn *Connection) WriteLoop() error {
+	logger.Debug("start connection.WriteLoop")
+	for {
+		select {
+		case <-conn.scheduler.ready:
+		case <-conn.closed:
+			return nil
+		}
+
+		// frames taken from the scheduler are written before Close
+		for !conn.isClosed() {
+			conn.writeMu.Lock()
+			frames := conn.scheduler.pop()
+			if frames == nil {
+				conn.writeMu.Unlock()
+				break
+			}
+			for _, frame := range frames {
+				logger.Notice("%v %v", color.Red("send"), util.Indent(frame.String()))
+
+				err := frame.Write(conn.RW)
+				if err != nil {
+					conn.writeMu.Unlock()
+					logger.Error("connection frame.Write error, err: %v", err)
+					conn.Close()
+					return err
+				}
+			}
+			conn.writeMu.Unlock()
+		}
+	}
+}
+
+// WriteFrame queues f to WriteLoop.
+// Frames written after the connection is closed are dropped.
+func (conn *Connection) WriteFrame(f frame.Frame) {
+	conn.WriteFrames(f)
+}
+
+// WriteFrames queues frames in order, with no other frame written
+// in between, and waits until WriteLoop takes them
+func (conn *Connection) WriteFrames(frames ...frame.Frame) {
+	if len(frames) == 0 {
+		return
+	}
+	select {
+	case <-conn.scheduler.push(frames):
+	case <-conn.closed:
+		logger.Debug("drop %v frame on closed connection", frames[0].Header().Type)
+	}
+}
+
 func (conn *Connection) PingACK(opaqueData []byte) {
 	logger.Debug("Ping ACK with opaque(%v)", opaqueData)
 	pingACK := frame.NewPingFrame(frame.PING_ACK, 0, opaqueData)
-	conn.WriteChan <- pingACK
+	conn.WriteFrame(pingACK)
 }
 
-func (conn *Connection) GoAway(streamID uint32, h2Error *H2Error) {
+func (conn *Connection) GoAway(streamID uint32, h2Error *h2.H2Error) {
 	logger.Debug("connection close with GO_AWAY(%v)", h2Error)
 	errorCode := h2Error.ErrCode
 	additionalDebugData := []byte(h2Error.AdditionalDebugData)
 	goaway := frame.NewGoAwayFrame(streamID, conn.LastStreamID, errorCode, additionalDebugData)
-	conn.WriteChan <- goaway
+	conn.markGoingAway()
+	conn.WriteFrame(goaway)
+}
+
+// growWindow raises the receive windows of the connection and the streams
+// to size, which the peer applies to the streams by SETTINGS_INITIAL_WINDOW_SIZE.
+// size 0 leaves them as is.
+func (conn *Connection) growWindow(size int32) {
+	if size == 0 {
+		return
+	}
+	logger.Debug("grow receive window to %d", size)
+	if increment := conn.Window.Grow(size); increment > 0 {
+		conn.WriteFrame(frame.NewWindowUpdateFrame(0, uint32(increment)))
+	}
+
+	conn.mu.Lock()
+	conn.Settings[frame.SETTINGS_INITIAL_WINDOW_SIZE] = size
+	conn.mu.Unlock()
+	for _, stream := range conn.streams() {
+		stream.Window.Grow(size)
+	}
+	settings := map[frame.SettingsID]int32{frame.SETTINGS_INITIAL_WINDOW_SIZE: size}
+	conn.WriteFrame(frame.NewSettingsFrame(frame.UNSET, 0, settings))
+}
+
+// discard consumes the connection window for f
+// which is not passed to any stream
+func (conn *Connection) discard(f frame.Frame) {
+	if f.Header().Type == frame.DataFrameType {
+		conn.WindowConsume(int32(f.Header().Length))
+	}
 }
 
 func (conn *Connection) WindowConsume(length int32) {
@@ -255,8 +951,7 @@ func (conn *Connection) WindowConsume(length int32) {
 	update := conn.Window.Consume(length)
 
 	if update > 0 {
-		conn.WriteChan <- frame.NewWindowUpdateFrame(0, uint32(update))
-		conn.Window.Update(update)
+		conn.WriteFrame(frame.NewWindowUpdateFrame(0, uint32(update)))
 	}
 }
 
@@ -282,12 +977,18 @@ func (conn *Connection) ReadMagic() error {
 }
 
 func (conn *Connection) Close() {
-	logger.Info("close all connection.frame")
-	for i, stream := range conn.Streams {
-		if stream != nil {
-			logger.Debug("close stream(%d)", i)
-			stream.Close()
+	conn.closeOnce.Do(func() {
+		logger.Info("close all connection.frame")
+		conn.markGoingAway()
+		close(conn.closed)
+		conn.writeMu.Lock()
+		if closer, ok := conn.RW.(io.Closer); ok {
+			closer.Close()
 		}
-	}
-	close(conn.WriteChan)
+		conn.writeMu.Unlock()
+		for _, stream := range conn.streams() {
+			logger.Debug("close stream(%d)", stream.ID)
+			stream.Reset(ErrConnectionClosed)
+		}
+	})
 }
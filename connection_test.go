@@ -0,0 +1,453 @@
+package minimalist_http2
+
+import (
+	"io"
+	"io/ioutil"
+	"minimalist-http2/frame"
+	"minimalist-http2/h2"
+	"minimalist-http2/hpack"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testPeer is the client end of a server connection,
+// which writes and reads raw frames
+type testPeer struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *hpack.Encoder
+	// HEADERS from the server are decoded as they are read
+	decoder *hpack.Decoder
+	frames  chan frame.Frame
+}
+
+// newTestServer serves handler on a connection over net.Pipe, which setup
+// configures before it starts, and returns it with the peer after the
+// preface and SETTINGS
+func newTestServer(t *testing.T, handler http.Handler, setup ...func(conn *Connection)) (*Connection, *testPeer) {
+	server, client := net.Pipe()
+	conn := NewServerConnection(server)
+	conn.CallBack = HandlerCallBack(handler)
+	for _, f := range setup {
+		f(conn)
+	}
+	go func() {
+		if err := conn.ReadMagic(); err != nil {
+			return
+		}
+		go conn.WriteLoop()
+		conn.WriteFrame(frame.NewSettingsFrame(frame.UNSET, 0, conn.Settings))
+		conn.ReadLoop()
+		conn.Close()
+	}()
+
+	if _, err := client.Write([]byte(CONNECTION_PREFACE)); err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestPeer(t, client)
+	peer.write(frame.NewSettingsFrame(frame.UNSET, 0, map[frame.SettingsID]int32{}))
+	return conn, peer
+}
+
+// newTestClient opens a client connection over net.Pipe
+// and returns it with the peer after the preface and SETTINGS
+func newTestClient(t *testing.T) (*Connection, *testPeer) {
+	server, client := net.Pipe()
+	conn := NewConnection(client)
+	conn.Origin = "https://example.com:443"
+	go func() {
+		if err := conn.WriteMagic(); err != nil {
+			return
+		}
+		go conn.WriteLoop()
+		conn.WriteFrame(frame.NewSettingsFrame(frame.UNSET, 0, conn.Settings))
+		conn.ReadLoop()
+		conn.Close()
+	}()
+
+	preface := make([]byte, len(CONNECTION_PREFACE))
+	if _, err := io.ReadFull(server, preface); err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestPeer(t, server)
+	peer.write(frame.NewSettingsFrame(frame.UNSET, 0, map[frame.SettingsID]int32{}))
+	return conn, peer
+}
+
+// newTestPeer reads frames from conn until it's closed at the end of t
+func newTestPeer(t *testing.T, conn net.Conn) *testPeer {
+	peer := &testPeer{
+		t:       t,
+		conn:    conn,
+		encoder: hpack.NewEncoder(uint32(frame.DEFAULT_HEADER_TABLE_SIZE)),
+		decoder: hpack.NewDecoder(uint32(frame.DEFAULT_HEADER_TABLE_SIZE)),
+		frames:  make(chan frame.Frame, 1024),
+	}
+	go func() {
+		defer close(peer.frames)
+		for {
+			f, err := frame.ReadFrame(conn, DefaultSettings)
+			if err != nil {
+				return
+			}
+			if headersFrame, ok := f.(*frame.HeadersFrame); ok {
+				headerList, err := peer.decoder.Decode(headersFrame.HeaderBlockFragment)
+				if err != nil {
+					return
+				}
+				headersFrame.Headers = headerList.ToHeader()
+			}
+			peer.frames <- f
+		}
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return peer
+}
+
+func (peer *testPeer) write(f frame.Frame) {
+	peer.t.Helper()
+	if err := f.Write(peer.conn); err != nil {
+		peer.t.Fatal(err)
+	}
+}
+
+// writeRaw writes a frame header followed by length bytes of payload,
+// which the frame types would not encode
+func (peer *testPeer) writeRaw(types frame.FrameType, flags frame.Flag, streamID uint32, length int) {
+	peer.t.Helper()
+	b := []byte{
+		byte(length >> 16), byte(length >> 8), byte(length), byte(types), byte(flags),
+		byte(streamID >> 24), byte(streamID >> 16), byte(streamID >> 8), byte(streamID),
+	}
+	if _, err := peer.conn.Write(append(b, make([]byte, length)...)); err != nil {
+		peer.t.Fatal(err)
+	}
+}
+
+// writeHeaders opens streamID with a request to path
+func (peer *testPeer) writeHeaders(streamID uint32, method, path string, flags frame.Flag) {
+	peer.t.Helper()
+	peer.writeHeaderBlock(streamID, testRequestHeader(method, path), flags)
+}
+
+// writeHeaderBlock sends header in a HEADERS frame
+func (peer *testPeer) writeHeaderBlock(streamID uint32, header http.Header, flags frame.Flag) {
+	peer.t.Helper()
+	headerBlock := peer.encoder.Encode(*hpack.ToHeaderList(header))
+	peer.write(frame.NewHeadersFrame(flags|frame.HEADERS_END_HEADERS, streamID, nil, headerBlock, nil))
+}
+
+func testRequestHeader(method, path string) http.Header {
+	return http.Header{
+		":method":    {method},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+		":path":      {path},
+	}
+}
+
+// expect returns the first frame match is true for, skipping the others
+func (peer *testPeer) expect(match func(f frame.Frame) bool) frame.Frame {
+	peer.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-peer.frames:
+			if !ok {
+				peer.t.Fatal("connection closed")
+			}
+			if match(f) {
+				return f
+			}
+		case <-timeout:
+			peer.t.Fatal("timeout")
+		}
+	}
+}
+
+// response returns HEADERS and DATA frames of streamID
+// until the one with END_STREAM
+func (peer *testPeer) response(streamID uint32) []frame.Frame {
+	peer.t.Helper()
+	var frames []frame.Frame
+	for {
+		f := peer.expect(func(f frame.Frame) bool {
+			types := f.Header().Type
+			return f.Header().StreamID == streamID &&
+				(types == frame.HeadersFrameType || types == frame.DataFrameType)
+		})
+		frames = append(frames, f)
+		if f.Header().Flags.Has(frame.HEADERS_END_STREAM) {
+			return frames
+		}
+	}
+}
+
+func isRstStream(streamID uint32, code h2.ErrCode) func(f frame.Frame) bool {
+	return func(f frame.Frame) bool {
+		rst, ok := f.(*frame.RstStreamFrame)
+		return ok && rst.StreamID == streamID && rst.ErrCode == code
+	}
+}
+
+func TestOversizedDataConsumesConnectionWindow(t *testing.T) {
+	_, peer := newTestServer(t, http.NotFoundHandler())
+
+	// two DATA over SETTINGS_MAX_FRAME_SIZE are more than
+	// half of the connection window together
+	size := int(frame.DEFAULT_MAX_FRAME_SIZE) + 1
+	peer.writeHeaders(1, "POST", "/", frame.UNSET)
+	peer.writeRaw(frame.DataFrameType, frame.UNSET, 1, size)
+	peer.expect(isRstStream(1, h2.FRAME_SIZE_ERROR))
+	peer.writeRaw(frame.DataFrameType, frame.UNSET, 1, size)
+
+	f := peer.expect(func(f frame.Frame) bool {
+		_, ok := f.(*frame.WindowUpdateFrame)
+		return ok && f.Header().StreamID == 0
+	})
+	if increment := f.(*frame.WindowUpdateFrame).WindowSizeIncrement; increment != uint32(2*size) {
+		t.Errorf("WindowSizeIncrement = %d, want %d", increment, 2*size)
+	}
+}
+
+// testExtensionFrame is a frame type added by RegisterFrameType
+type testExtensionFrame struct {
+	frame.UnknownFrame
+}
+
+const testExtensionType frame.FrameType = 0xf0
+
+func init() {
+	frame.RegisterFrameType(testExtensionType, func(fh *frame.HeaderFrame) frame.Frame {
+		return &testExtensionFrame{frame.UnknownFrame{HeaderFrame: fh}}
+	})
+}
+
+func TestRegisteredFrameTypeOnIdleStream(t *testing.T) {
+	received := make(chan frame.Frame, 1)
+	conn, peer := newTestServer(t, http.NotFoundHandler(), func(conn *Connection) {
+		conn.ExtensionCallBack = func(f frame.Frame) {
+			received <- f
+		}
+	})
+
+	peer.writeRaw(testExtensionType, frame.UNSET, 1, 4)
+	select {
+	case f := <-received:
+		if _, ok := f.(*testExtensionFrame); !ok || f.Header().StreamID != 1 {
+			t.Errorf("ExtensionCallBack got %v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ExtensionCallBack not called")
+	}
+
+	// the connection is still usable and stream 1 is still idle
+	peer.write(frame.NewPingFrame(frame.UNSET, 0, []byte("12345678")))
+	peer.expect(func(f frame.Frame) bool {
+		if _, ok := f.(*frame.GoAwayFrame); ok {
+			t.Fatalf("got %v", f)
+		}
+		return f.Header().Type == frame.PingFrameType
+	})
+	if _, ok := conn.Stream(1); ok {
+		t.Error("stream 1 opened by an extension frame")
+	}
+}
+
+func TestSettingsUnknownFlags(t *testing.T) {
+	const unknownFlag frame.Flag = 0x80
+
+	_, peer := newTestServer(t, http.NotFoundHandler())
+	peer.write(frame.NewSettingsFrame(unknownFlag, 0, map[frame.SettingsID]int32{
+		frame.SETTINGS_MAX_CONCURRENT_STREAMS: 10,
+	}))
+	// the first SETTINGS of the peer is acknowledged before
+	peer.expect(func(f frame.Frame) bool {
+		return f.Header().Type == frame.SettingsFrameType && f.Header().Flags.Has(frame.SETTINGS_ACK)
+	})
+	peer.expect(func(f frame.Frame) bool {
+		return f.Header().Type == frame.SettingsFrameType && f.Header().Flags.Has(frame.SETTINGS_ACK)
+	})
+
+	_, peer = newTestServer(t, http.NotFoundHandler())
+	peer.write(frame.NewSettingsFrame(unknownFlag, 0, map[frame.SettingsID]int32{
+		frame.SETTINGS_MAX_FRAME_SIZE: 1,
+	}))
+	f := peer.expect(func(f frame.Frame) bool {
+		return f.Header().Type == frame.GoAwayFrameType
+	})
+	if code := f.(*frame.GoAwayFrame).ErrorCode; code != h2.PROTOCOL_ERROR {
+		t.Errorf("GOAWAY %v, want PROTOCOL_ERROR", code)
+	}
+}
+
+// echoHandler responds with X-Test of the request
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Test", r.Header.Get("X-Test"))
+	w.WriteHeader(http.StatusOK)
+})
+
+// request sends a request with X-Test on streamID and returns
+// X-Test of the response
+func (peer *testPeer) request(streamID uint32, value string) string {
+	peer.t.Helper()
+	header := testRequestHeader("GET", "/")
+	header.Set("X-Test", value)
+	peer.writeHeaderBlock(streamID, header, frame.HEADERS_END_STREAM)
+	return peer.response(streamID)[0].(*frame.HeadersFrame).Headers.Get("X-Test")
+}
+
+func TestHeaderTablePerConnection(t *testing.T) {
+	connA, peerA := newTestServer(t, echoHandler)
+	connB, peerB := newTestServer(t, echoHandler)
+
+	// the second response of A refers to the dynamic table of A,
+	// which B must not use for its response
+	for _, streamID := range []uint32{1, 3} {
+		if value := peerA.request(streamID, "a"); value != "a" {
+			t.Errorf("X-Test of A = %q, want a", value)
+		}
+	}
+	if value := peerB.request(1, "b"); value != "b" {
+		t.Errorf("X-Test of B = %q, want b", value)
+	}
+
+	if connA.Encoder == connB.Encoder || connA.Decoder == connB.Decoder {
+		t.Fatal("connections share HPACK state")
+	}
+	for _, hf := range connB.Decoder.HT.HeaderFields {
+		if hf.Value == "a" {
+			t.Errorf("decoder of B has %s: %s of A", hf.Name, hf.Value)
+		}
+	}
+	for _, hf := range connB.Encoder.HT.HeaderFields {
+		if hf.Value == "a" {
+			t.Errorf("encoder of B has %s: %s of A", hf.Name, hf.Value)
+		}
+	}
+}
+
+func TestSettingsHeaderTableSize(t *testing.T) {
+	conn, peer := newTestServer(t, echoHandler)
+	peer.write(frame.NewSettingsFrame(frame.UNSET, 0, map[frame.SettingsID]int32{
+		frame.SETTINGS_HEADER_TABLE_SIZE: 0,
+	}))
+	for i := 0; i < 2; i++ {
+		peer.expect(func(f frame.Frame) bool {
+			return f.Header().Type == frame.SettingsFrameType && f.Header().Flags.Has(frame.SETTINGS_ACK)
+		})
+	}
+
+	// the response starts with a size update of 0 and indexes nothing
+	if value := peer.request(1, "a"); value != "a" {
+		t.Errorf("X-Test = %q, want a", value)
+	}
+	if size := conn.Encoder.HT.DYNAMIC_TABLE_SIZE; size != 0 {
+		t.Errorf("encoder table max size %d, want 0", size)
+	}
+	if size := peer.decoder.HT.DYNAMIC_TABLE_SIZE; size != 0 {
+		t.Errorf("table max size of the peer %d, want 0", size)
+	}
+	if n := len(conn.Encoder.HT.HeaderFields); n != 0 {
+		t.Errorf("encoder table has %d entries, want 0", n)
+	}
+}
+
+func TestRequestBodyStreamedToHandler(t *testing.T) {
+	started := make(chan *http.Request, 1)
+	proceed := make(chan struct{})
+	_, peer := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r
+		<-proceed
+		n, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			t.Errorf("body: %v", err)
+		}
+		w.Header().Set("X-Length", strconv.FormatInt(n, 10))
+		w.Header().Set("X-Trailer", r.Trailer.Get("X-Trailer"))
+	}))
+
+	// the handler is called at HEADERS, before the body
+	header := testRequestHeader("POST", "/")
+	header.Set("Trailer", "X-Trailer")
+	peer.writeHeaderBlock(1, header, frame.UNSET)
+	select {
+	case r := <-started:
+		if r.ContentLength != -1 {
+			t.Errorf("ContentLength = %d, want -1", r.ContentLength)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called at HEADERS")
+	}
+
+	// the window is not opened again while the handler reads nothing
+	size := int(frame.DEFAULT_INITIAL_WINDOW_SIZE)
+	for sent := 0; sent < size; sent += int(frame.DEFAULT_MAX_FRAME_SIZE) {
+		length := size - sent
+		if length > int(frame.DEFAULT_MAX_FRAME_SIZE) {
+			length = int(frame.DEFAULT_MAX_FRAME_SIZE)
+		}
+		peer.writeRaw(frame.DataFrameType, frame.UNSET, 1, length)
+	}
+	peer.write(frame.NewPingFrame(frame.UNSET, 0, []byte("12345678")))
+	peer.expect(func(f frame.Frame) bool {
+		if _, ok := f.(*frame.WindowUpdateFrame); ok {
+			t.Fatalf("%v before the handler reads", f)
+		}
+		return f.Header().Type == frame.PingFrameType
+	})
+
+	close(proceed)
+	peer.expect(func(f frame.Frame) bool {
+		_, ok := f.(*frame.WindowUpdateFrame)
+		return ok && f.Header().StreamID == 1
+	})
+	peer.writeHeaderBlock(1, http.Header{"X-Trailer": {"v"}}, frame.HEADERS_END_STREAM)
+
+	res := peer.response(1)[0].(*frame.HeadersFrame).Headers
+	if length := res.Get("X-Length"); length != strconv.Itoa(size) {
+		t.Errorf("handler read %s bytes, want %d", length, size)
+	}
+	if trailer := res.Get("X-Trailer"); trailer != "v" {
+		t.Errorf("request trailer X-Trailer = %q, want v", trailer)
+	}
+}
+
+func TestPriorityFloodOnIdleStreams(t *testing.T) {
+	conn, peer := newTestServer(t, echoHandler)
+
+	// PRIORITY neither opens the streams nor keeps their nodes
+	for streamID := uint32(1); streamID < 2000; streamID += 2 {
+		peer.write(frame.NewPriorityFrame(streamID, false, streamID+2, 16))
+	}
+	peer.write(frame.NewPingFrame(frame.UNSET, 0, []byte("12345678")))
+	peer.expect(func(f frame.Frame) bool {
+		if _, ok := f.(*frame.GoAwayFrame); ok {
+			t.Fatalf("got %v", f)
+		}
+		return f.Header().Type == frame.PingFrameType
+	})
+
+	conn.scheduler.mu.Lock()
+	nodes := len(conn.scheduler.nodes)
+	conn.scheduler.mu.Unlock()
+	if nodes > maxIdleNodes {
+		t.Errorf("%d priority nodes, want at most %d", nodes, maxIdleNodes)
+	}
+	conn.mu.Lock()
+	streams := len(conn.Streams)
+	conn.mu.Unlock()
+	if streams != 0 || conn.LastStreamID != 0 {
+		t.Errorf("%d streams and last stream %d after PRIORITY, want none", streams, conn.LastStreamID)
+	}
+
+	// stream IDs which only had PRIORITY can still be opened
+	if value := peer.request(1, "a"); value != "a" {
+		t.Errorf("X-Test = %q, want a", value)
+	}
+}
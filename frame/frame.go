@@ -1,15 +1,25 @@
 package frame
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/Jxck/logger"
 	"io"
-	"minimalist-http2"
+	"io/ioutil"
+	"minimalist-http2/h2"
 	"net/http"
+	"sort"
 )
 
 const frameHeaderLen = 9
 
+const (
+	maskLength    uint32 = 0xffffff   // 24 bit
+	maskStreamID  uint32 = 0x7fffffff // remove reserved 1 bit
+	maskExclusive uint32 = 0x80000000
+)
+
 var padZeores = make([]byte, 255) // zero for padding
 
 type FrameType uint8
@@ -31,21 +41,31 @@ const (
 
 // overwrite
 func (frameType FrameType) String() string {
-	types := []string{
-		"DATA",
-		"HEADERS",
-		"PRIORITY",
-		"RES_STREAM",
-		"SETTINGS",
-		"PUSH_PROMISE",
-		"PING",
-		"GOAWAY",
-		"WINDOW_UPDATE",
-		"CONTINUATION",
-		"ALTSVC",
-		"ORIGIN",
-	}
-	return types[int(frameType)]
+	types := map[FrameType]string{
+		DataFrameType:         "DATA",
+		HeadersFrameType:      "HEADERS",
+		PriorityFrameType:     "PRIORITY",
+		RstStreamFrameType:    "RST_STREAM",
+		SettingsFrameType:     "SETTINGS",
+		PushPromiseFrameType:  "PUSH_PROMISE",
+		PingFrameType:         "PING",
+		GoAwayFrameType:       "GOAWAY",
+		WindowUpdateFrameType: "WINDOW_UPDATE",
+		ContinuationFrameType: "CONTINUATION",
+		AltsvcFrameType:       "ALTSVC",
+		OriginFrameType:       "ORIGIN",
+	}
+	name, ok := types[frameType]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%#x)", uint8(frameType))
+	}
+	return name
+}
+
+// IsExtension is true for types defined outside of RFC 9113 section 6,
+// which never change the state of streams, section 5.5
+func (frameType FrameType) IsExtension() bool {
+	return frameType > ContinuationFrameType
 }
 
 // Flags is a bitmask of HTTP/2 flags.
@@ -69,7 +89,8 @@ const (
 	HEADERS_PADDED      = 0x8
 	HEADERS_PRIORITY    = 0x20
 
-	PING_ACK = 0x1
+	SETTINGS_ACK = 0x1
+	PING_ACK     = 0x1
 
 	CONTINUAION_END_HEADERS  = 0x4
 	PUSH_PROMISE_END_HEADERS = 0x4
@@ -112,6 +133,15 @@ var FrameMap = map[FrameType](func(*HeaderFrame) Frame){
 	GoAwayFrameType:       func(fh *HeaderFrame) Frame { return &GoAwayFrame{HeaderFrame: fh} },
 	WindowUpdateFrameType: func(fh *HeaderFrame) Frame { return &WindowUpdateFrame{HeaderFrame: fh} },
 	ContinuationFrameType: func(fh *HeaderFrame) Frame { return &ContinuationFrame{HeaderFrame: fh} },
+	AltsvcFrameType:       func(fh *HeaderFrame) Frame { return &AltSvcFrame{HeaderFrame: fh} },
+	OriginFrameType:       func(fh *HeaderFrame) Frame { return &OriginFrame{HeaderFrame: fh} },
+}
+
+// RegisterFrameType adds an initializer for an extension frame type,
+// so ReadFrame returns it instead of an UnknownFrame.
+// It is not safe to call while connections are reading frames.
+func RegisterFrameType(frameType FrameType, newFrame func(*HeaderFrame) Frame) {
+	FrameMap[frameType] = newFrame
 }
 
 // Frame Header
@@ -144,15 +174,103 @@ func NewFrameHeader(length uint32, types FrameType, flags Flag, streamID uint32)
 }
 
 func (f *HeaderFrame) Write(w io.Writer) error {
-	panic("implement me")
+	var b [frameHeaderLen]byte
+
+	// 24 bit length + 8 bit type
+	binary.BigEndian.PutUint32(b[0:4], (f.Length&maskLength)<<8|uint32(f.Type))
+	b[4] = byte(f.Flags)
+	// reserved bit is always sent as 0
+	binary.BigEndian.PutUint32(b[5:9], f.StreamID&maskStreamID)
+
+	_, err := w.Write(b[:])
+	return err
 }
 
 func (f *HeaderFrame) Read(r io.Reader) error {
-	panic("implement me")
+	var b [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+
+	first := binary.BigEndian.Uint32(b[0:4])
+	f.Length = first >> 8
+	f.Type = FrameType(first & 0xff)
+	f.Flags = Flag(b[4])
+	// reserved bit must be ignored when receiving
+	f.StreamID = binary.BigEndian.Uint32(b[5:9]) & maskStreamID
+	return nil
 }
 
 func (f *HeaderFrame) String() string {
-	panic("implement me")
+	return fmt.Sprintf(" frame <length=%v, flags=%#x, stream_id=%v>", f.Length, uint8(f.Flags), f.StreamID)
+}
+
+// readPayload reads the whole payload declared in the frame header.
+func (f *HeaderFrame) readPayload(r io.Reader) ([]byte, error) {
+	payload := make([]byte, f.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// sizeError returns the FRAME_SIZE_ERROR for this frame.
+//
+// section 4.2
+// A frame size error in a frame that could alter the state of the entire connection
+// MUST be treated as a connection error; this includes any frame carrying a field block
+// (that is, HEADERS, PUSH_PROMISE, and CONTINUATION), a SETTINGS frame,
+// and any frame with a stream identifier of 0.
+func (f *HeaderFrame) sizeError() error {
+	switch f.Type {
+	case HeadersFrameType, PushPromiseFrameType, ContinuationFrameType, SettingsFrameType,
+		// section 6.4, 6.7, 6.9 treat these as connection error regardless of stream
+		RstStreamFrameType, PingFrameType, WindowUpdateFrameType:
+		return h2.ConnectionError(h2.FRAME_SIZE_ERROR)
+	}
+	if f.StreamID == 0 {
+		return h2.ConnectionError(h2.FRAME_SIZE_ERROR)
+	}
+	return h2.StreamError{StreamID: f.StreamID, Code: h2.FRAME_SIZE_ERROR}
+}
+
+// validate checks the frame length against SETTINGS_MAX_FRAME_SIZE
+// before any of the payload is read.
+func (f *HeaderFrame) validate() error {
+	maxFrameSize := f.MaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	if f.Length > uint32(maxFrameSize) {
+		return f.sizeError()
+	}
+	return nil
+}
+
+// newPayloadBuffer returns a buffer holding the encoded frame header,
+// ready for the frame payload to be appended.
+func (f *HeaderFrame) newPayloadBuffer() *bytes.Buffer {
+	buf := bytes.NewBuffer(make([]byte, 0, frameHeaderLen+int(f.Length)))
+	f.Write(buf) // writing to bytes.Buffer never fails
+	return buf
+}
+
+// removePadding strips the Pad Length field and the trailing padding
+// from the payload of a PADDED frame.
+func removePadding(payload []byte) (padLength uint8, data, padding []byte, err error) {
+	if len(payload) < 1 {
+		return 0, nil, nil, h2.ConnectionError(h2.FRAME_SIZE_ERROR)
+	}
+	padLength = payload[0]
+	payload = payload[1:]
+	// section 6.1
+	// If the length of the padding is the length of the frame payload or greater,
+	// the recipient MUST treat this as a connection error of type PROTOCOL_ERROR.
+	if int(padLength) > len(payload) {
+		return 0, nil, nil, h2.ConnectionError(h2.PROTOCOL_ERROR)
+	}
+	split := len(payload) - int(padLength)
+	return padLength, payload[:split], payload[split:], nil
 }
 
 // Frame Data
@@ -191,19 +309,51 @@ func NewDataFrame(flags Flag, streamID uint32, data, padding []byte) *DataFrame
 }
 
 func (f *DataFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+
+	padded := f.Flags.Has(DATA_PADDED)
+	if padded {
+		buf.WriteByte(f.PadLength)
+	}
+	buf.Write(f.Data)
+	if padded {
+		buf.Write(padZeores[:f.PadLength])
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *DataFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+
+	if f.Flags.Has(DATA_PADDED) {
+		f.PadLength, payload, f.Padding, err = removePadding(payload)
+		if err != nil {
+			return err
+		}
+	}
+	f.Data = payload
+	return nil
 }
 
 func (f *DataFrame) Header() *HeaderFrame {
-	panic("implement me")
+	return f.HeaderFrame
 }
 
 func (f *DataFrame) String() string {
-	panic("implement me")
+	str := "DATA" + f.HeaderFrame.String()
+	if f.Flags.Has(DATA_END_STREAM) {
+		str += "\n+ END_STREAM"
+	}
+	if f.Flags.Has(DATA_PADDED) {
+		str += fmt.Sprintf("\n+ PADDED (pad_length=%d)", f.PadLength)
+	}
+	str += fmt.Sprintf("\ndata=%d byte", len(f.Data))
+	return str
 }
 
 // HEADERS
@@ -234,6 +384,34 @@ type DependencyTree struct {
 	Weight           uint8
 }
 
+// write E + Stream Dependency(31) + Weight(8)
+func (tree *DependencyTree) write(buf *bytes.Buffer) {
+	writePriority(buf, tree.Exclusive, tree.StreamDependency, tree.Weight)
+}
+
+func readDependencyTree(b []byte) *DependencyTree {
+	exclusive, streamDependency, weight := readPriority(b)
+	return &DependencyTree{
+		Exclusive:        exclusive,
+		StreamDependency: streamDependency,
+		Weight:           weight,
+	}
+}
+
+func writePriority(buf *bytes.Buffer, exclusive bool, streamDependency uint32, weight uint8) {
+	dependency := streamDependency & maskStreamID
+	if exclusive {
+		dependency |= maskExclusive
+	}
+	binary.Write(buf, binary.BigEndian, dependency)
+	buf.WriteByte(weight)
+}
+
+func readPriority(b []byte) (exclusive bool, streamDependency uint32, weight uint8) {
+	dependency := binary.BigEndian.Uint32(b[0:4])
+	return dependency&maskExclusive == maskExclusive, dependency & maskStreamID, b[4]
+}
+
 func NewHeadersFrame(flags Flag, streamID uint32, dependenctTree *DependencyTree, headerBlockFragment, padding []byte) *HeadersFrame {
 	var padded bool = flags&HEADERS_PADDED == HEADERS_PADDED
 	var priority bool = flags&HEADERS_PRIORITY == HEADERS_PRIORITY
@@ -243,7 +421,7 @@ func NewHeadersFrame(flags Flag, streamID uint32, dependenctTree *DependencyTree
 		length = length + len(padding) + 1
 	}
 	if priority {
-		length = length + 1
+		length = length + 5 // E + Stream Dependency(31) + Weight(8)
 	}
 	return &HeadersFrame{
 		HeaderFrame:         NewFrameHeader(uint32(length), HeadersFrameType, flags, streamID),
@@ -255,11 +433,49 @@ func NewHeadersFrame(flags Flag, streamID uint32, dependenctTree *DependencyTree
 }
 
 func (f *HeadersFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+
+	padded := f.Flags.Has(HEADERS_PADDED)
+	if padded {
+		buf.WriteByte(f.PadLength)
+	}
+	if f.Flags.Has(HEADERS_PRIORITY) {
+		tree := f.DependencyTree
+		if tree == nil {
+			tree = new(DependencyTree)
+		}
+		tree.write(buf)
+	}
+	buf.Write(f.HeaderBlockFragment)
+	if padded {
+		buf.Write(padZeores[:f.PadLength])
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *HeadersFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+
+	if f.Flags.Has(HEADERS_PADDED) {
+		f.PadLength, payload, f.Padding, err = removePadding(payload)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Flags.Has(HEADERS_PRIORITY) {
+		if len(payload) < 5 {
+			return f.sizeError()
+		}
+		f.DependencyTree = readDependencyTree(payload[:5])
+		payload = payload[5:]
+	}
+	f.HeaderBlockFragment = payload
+	return nil
 }
 
 func (f *HeadersFrame) Header() *HeaderFrame {
@@ -267,7 +483,24 @@ func (f *HeadersFrame) Header() *HeaderFrame {
 }
 
 func (f *HeadersFrame) String() string {
-	panic("implement me")
+	str := "HEADERS" + f.HeaderFrame.String()
+	if f.Flags.Has(HEADERS_END_STREAM) {
+		str += "\n+ END_STREAM"
+	}
+	if f.Flags.Has(HEADERS_END_HEADERS) {
+		str += "\n+ END_HEADERS"
+	}
+	if f.Flags.Has(HEADERS_PADDED) {
+		str += fmt.Sprintf("\n+ PADDED (pad_length=%d)", f.PadLength)
+	}
+	if f.Flags.Has(HEADERS_PRIORITY) && f.DependencyTree != nil {
+		str += fmt.Sprintf("\n+ PRIORITY (exclusive=%v, dependency=%d, weight=%d)",
+			f.DependencyTree.Exclusive, f.DependencyTree.StreamDependency, f.DependencyTree.Weight)
+	}
+	for name, value := range f.Headers {
+		str += fmt.Sprintf("\n%s: %s", name, value)
+	}
+	return str
 }
 
 // PRIORITY
@@ -297,11 +530,22 @@ func NewPriorityFrame(streamID uint32, exclusive bool, streamDependency uint32,
 }
 
 func (f *PriorityFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	writePriority(buf, f.Exclusive, f.StreamDependency, f.Weight)
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *PriorityFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) != 5 {
+		return f.sizeError()
+	}
+	f.Exclusive, f.StreamDependency, f.Weight = readPriority(payload)
+	return nil
 }
 
 func (f *PriorityFrame) Header() *HeaderFrame {
@@ -309,7 +553,9 @@ func (f *PriorityFrame) Header() *HeaderFrame {
 }
 
 func (f *PriorityFrame) String() string {
-	panic("implement me")
+	str := "PRIORITY" + f.HeaderFrame.String()
+	str += fmt.Sprintf("\nexclusive=%v, dependency=%d, weight=%d", f.Exclusive, f.StreamDependency, f.Weight)
+	return str
 }
 
 // RST_STREAM
@@ -319,10 +565,10 @@ func (f *PriorityFrame) String() string {
 // +---------------------------------------------------------------+
 type RstStreamFrame struct {
 	*HeaderFrame
-	ErrCode minimalist_http2.ErrCode
+	ErrCode h2.ErrCode
 }
 
-func NewRstStreamFrame(streamID uint32, errorCode minimalist_http2.ErrCode) *RstStreamFrame {
+func NewRstStreamFrame(streamID uint32, errorCode h2.ErrCode) *RstStreamFrame {
 	var length uint32 = 4
 
 	return &RstStreamFrame{
@@ -332,11 +578,22 @@ func NewRstStreamFrame(streamID uint32, errorCode minimalist_http2.ErrCode) *Rst
 }
 
 func (f *RstStreamFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	binary.Write(buf, binary.BigEndian, uint32(f.ErrCode))
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *RstStreamFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) != 4 {
+		return f.sizeError()
+	}
+	f.ErrCode = h2.ErrCode(binary.BigEndian.Uint32(payload))
+	return nil
 }
 
 func (f *RstStreamFrame) Header() *HeaderFrame {
@@ -344,7 +601,7 @@ func (f *RstStreamFrame) Header() *HeaderFrame {
 }
 
 func (f *RstStreamFrame) String() string {
-	panic("implement me")
+	return fmt.Sprintf("RST_STREAM%v\nerror_code=%v", f.HeaderFrame.String(), f.ErrCode)
 }
 
 // SETTINGS FRAME     section 6.5.1
@@ -373,6 +630,9 @@ const (
 	DEFAULT_MAX_HEADER_LIST_SIZE         = 2<<30 - 1
 )
 
+// section 6.5.2 the largest SETTINGS_MAX_FRAME_SIZE
+const MAX_FRAME_SIZE_LIMIT int32 = 1<<24 - 1
+
 func (s SettingsID) String() string {
 	m := map[SettingsID]string{
 		0x1: "SETTINGS_HEADER_TABLE_SIZE",
@@ -400,11 +660,48 @@ func NewSettingsFrame(flags Flag, streamID uint32, settings map[SettingsID]int32
 }
 
 func (f *SettingsFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	for _, id := range f.sortedIDs() {
+		binary.Write(buf, binary.BigEndian, uint16(id))
+		binary.Write(buf, binary.BigEndian, uint32(f.Settings[id]))
+	}
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *SettingsFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload)%6 != 0 {
+		return f.sizeError()
+	}
+	// section 6.5
+	// Receipt of a SETTINGS frame with the ACK flag set and a length field value
+	// other than 0 MUST be treated as a connection error of type FRAME_SIZE_ERROR.
+	if f.Flags.Has(SETTINGS_ACK) && len(payload) != 0 {
+		return f.sizeError()
+	}
+
+	f.Settings = make(map[SettingsID]int32, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		id := SettingsID(binary.BigEndian.Uint16(payload[i : i+2]))
+		value := binary.BigEndian.Uint32(payload[i+2 : i+6])
+		f.Settings[id] = int32(value)
+	}
+	return nil
+}
+
+// settings are written in order of their identifier
+// so the same map always produces the same bytes
+func (f *SettingsFrame) sortedIDs() []SettingsID {
+	ids := make([]SettingsID, 0, len(f.Settings))
+	for id := range f.Settings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
 }
 
 func (f *SettingsFrame) Header() *HeaderFrame {
@@ -412,7 +709,14 @@ func (f *SettingsFrame) Header() *HeaderFrame {
 }
 
 func (f *SettingsFrame) String() string {
-	panic("implement me")
+	str := "SETTINGS" + f.HeaderFrame.String()
+	if f.Flags.Has(SETTINGS_ACK) {
+		str += "\n+ ACK"
+	}
+	for _, id := range f.sortedIDs() {
+		str += fmt.Sprintf("\n%v:%v", id, f.Settings[id])
+	}
+	return str
 }
 
 // PUSH_PROMISE  section 6.6
@@ -453,11 +757,40 @@ func NewPushPromiseFrame(flags Flag, streamId, promisedStreamId uint32, headerBl
 }
 
 func (f *PushPromiseFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+
+	padded := f.Flags.Has(PUSH_PROMISE_PADDED)
+	if padded {
+		buf.WriteByte(f.PadLength)
+	}
+	binary.Write(buf, binary.BigEndian, f.PromisedStreamId&maskStreamID)
+	buf.Write(f.HeaderBlockFragment)
+	if padded {
+		buf.Write(padZeores[:f.PadLength])
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *PushPromiseFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+
+	if f.Flags.Has(PUSH_PROMISE_PADDED) {
+		f.PadLength, payload, f.Padding, err = removePadding(payload)
+		if err != nil {
+			return err
+		}
+	}
+	if len(payload) < 4 {
+		return f.sizeError()
+	}
+	f.PromisedStreamId = binary.BigEndian.Uint32(payload[0:4]) & maskStreamID
+	f.HeaderBlockFragment = payload[4:]
+	return nil
 }
 
 func (f *PushPromiseFrame) Header() *HeaderFrame {
@@ -465,7 +798,15 @@ func (f *PushPromiseFrame) Header() *HeaderFrame {
 }
 
 func (f *PushPromiseFrame) String() string {
-	panic("implement me")
+	str := "PUSH_PROMISE" + f.HeaderFrame.String()
+	if f.Flags.Has(PUSH_PROMISE_END_HEADERS) {
+		str += "\n+ END_HEADERS"
+	}
+	if f.Flags.Has(PUSH_PROMISE_PADDED) {
+		str += fmt.Sprintf("\n+ PADDED (pad_length=%d)", f.PadLength)
+	}
+	str += fmt.Sprintf("\npromised_stream_id=%d", f.PromisedStreamId)
+	return str
 }
 
 // PING
@@ -488,11 +829,24 @@ func NewPingFrame(flags Flag, streamID uint32, opaqueData []byte) *PingFrame {
 	}
 }
 func (f *PingFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	var opaqueData [8]byte
+	copy(opaqueData[:], f.OpaqueData)
+	buf.Write(opaqueData[:])
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *PingFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) != 8 {
+		return f.sizeError()
+	}
+	f.OpaqueData = payload
+	return nil
 }
 
 func (f *PingFrame) Header() *HeaderFrame {
@@ -500,7 +854,12 @@ func (f *PingFrame) Header() *HeaderFrame {
 }
 
 func (f *PingFrame) String() string {
-	panic("implement me")
+	str := "PING" + f.HeaderFrame.String()
+	if f.Flags.Has(PING_ACK) {
+		str += "\n+ ACK"
+	}
+	str += fmt.Sprintf("\nopaque_data=%q", f.OpaqueData)
+	return str
 }
 
 // GOAWAY
@@ -515,11 +874,11 @@ func (f *PingFrame) String() string {
 type GoAwayFrame struct {
 	*HeaderFrame
 	LastStreamID        uint32
-	ErrorCode           minimalist_http2.ErrCode
+	ErrorCode           h2.ErrCode
 	AdditionalDebugData []byte
 }
 
-func NewGoAwayFrame(streamID uint32, lastStreamID uint32, errorCode minimalist_http2.ErrCode, additionalDebugData []byte) *GoAwayFrame {
+func NewGoAwayFrame(streamID uint32, lastStreamID uint32, errorCode h2.ErrCode, additionalDebugData []byte) *GoAwayFrame {
 	var length = 8 + len(additionalDebugData)
 
 	return &GoAwayFrame{
@@ -531,11 +890,26 @@ func NewGoAwayFrame(streamID uint32, lastStreamID uint32, errorCode minimalist_h
 }
 
 func (f *GoAwayFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	binary.Write(buf, binary.BigEndian, f.LastStreamID&maskStreamID)
+	binary.Write(buf, binary.BigEndian, uint32(f.ErrorCode))
+	buf.Write(f.AdditionalDebugData)
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *GoAwayFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) < 8 {
+		return f.sizeError()
+	}
+	f.LastStreamID = binary.BigEndian.Uint32(payload[0:4]) & maskStreamID
+	f.ErrorCode = h2.ErrCode(binary.BigEndian.Uint32(payload[4:8]))
+	f.AdditionalDebugData = payload[8:]
+	return nil
 }
 
 func (f *GoAwayFrame) Header() *HeaderFrame {
@@ -543,7 +917,12 @@ func (f *GoAwayFrame) Header() *HeaderFrame {
 }
 
 func (f *GoAwayFrame) String() string {
-	panic("implement me")
+	str := "GOAWAY" + f.HeaderFrame.String()
+	str += fmt.Sprintf("\nlast_stream_id=%d, error_code=%v", f.LastStreamID, f.ErrorCode)
+	if len(f.AdditionalDebugData) > 0 {
+		str += fmt.Sprintf("\ndebug_data=%q", f.AdditionalDebugData)
+	}
+	return str
 }
 
 // WINDOW_UPDATE
@@ -566,11 +945,22 @@ func NewWindowUpdateFrame(streamID, incrementSize uint32) *WindowUpdateFrame {
 }
 
 func (f *WindowUpdateFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	binary.Write(buf, binary.BigEndian, f.WindowSizeIncrement&maskStreamID)
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *WindowUpdateFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) != 4 {
+		return f.sizeError()
+	}
+	f.WindowSizeIncrement = binary.BigEndian.Uint32(payload) & maskStreamID
+	return nil
 }
 
 func (f *WindowUpdateFrame) Header() *HeaderFrame {
@@ -578,7 +968,7 @@ func (f *WindowUpdateFrame) Header() *HeaderFrame {
 }
 
 func (f *WindowUpdateFrame) String() string {
-	panic("implement me")
+	return fmt.Sprintf("WINDOW_UPDATE%v\nwindow_size_increment=%d", f.HeaderFrame.String(), f.WindowSizeIncrement)
 }
 
 // CONTINUATION
@@ -600,11 +990,19 @@ func NewContinuationFrame(flags Flag, streamID uint32, headerBlockFragment []byt
 }
 
 func (f *ContinuationFrame) Write(w io.Writer) error {
-	panic("implement me")
+	buf := f.HeaderFrame.newPayloadBuffer()
+	buf.Write(f.HeaderBlockFragment)
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (f *ContinuationFrame) Read(r io.Reader) error {
-	panic("implement me")
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	f.HeaderBlockFragment = payload
+	return nil
 }
 
 func (f *ContinuationFrame) Header() *HeaderFrame {
@@ -612,9 +1010,181 @@ func (f *ContinuationFrame) Header() *HeaderFrame {
 }
 
 func (f *ContinuationFrame) String() string {
-	panic("implement me")
+	str := "CONTINUATION" + f.HeaderFrame.String()
+	if f.Flags.Has(CONTINUAION_END_HEADERS) {
+		str += "\n+ END_HEADERS"
+	}
+	return str
+}
+
+// ALTSVC  RFC 7838 section 4
+//
+// +-------------------------------+-------------------------------+
+// |         Origin-Len (16)       | Origin? (*)                 ...
+// +-------------------------------+-------------------------------+
+// |                   Alt-Svc-Field-Value (*)                   ...
+// +---------------------------------------------------------------+
+type AltSvcFrame struct {
+	*HeaderFrame
+	Origin     string
+	FieldValue string
+}
+
+func NewAltSvcFrame(streamID uint32, origin, fieldValue string) *AltSvcFrame {
+	length := 2 + len(origin) + len(fieldValue)
+
+	return &AltSvcFrame{
+		HeaderFrame: NewFrameHeader(uint32(length), AltsvcFrameType, UNSET, streamID),
+		Origin:      origin,
+		FieldValue:  fieldValue,
+	}
+}
+
+func (f *AltSvcFrame) Write(w io.Writer) error {
+	buf := f.HeaderFrame.newPayloadBuffer()
+	binary.Write(buf, binary.BigEndian, uint16(len(f.Origin)))
+	buf.WriteString(f.Origin)
+	buf.WriteString(f.FieldValue)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (f *AltSvcFrame) Read(r io.Reader) error {
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) < 2 {
+		return f.sizeError()
+	}
+	originLen := int(binary.BigEndian.Uint16(payload[0:2]))
+	payload = payload[2:]
+	if originLen > len(payload) {
+		return f.sizeError()
+	}
+	f.Origin = string(payload[:originLen])
+	f.FieldValue = string(payload[originLen:])
+	return nil
+}
+
+func (f *AltSvcFrame) Header() *HeaderFrame {
+	return f.HeaderFrame
+}
+
+func (f *AltSvcFrame) String() string {
+	return fmt.Sprintf("ALTSVC%v\norigin=%q\nalt-svc=%q", f.HeaderFrame.String(), f.Origin, f.FieldValue)
+}
+
+// ORIGIN  RFC 8336 section 2.1
+//
+// +-------------------------------+-------------------------------+
+// |         Origin-Len (16)       | ASCII-Origin?               ...
+// +-------------------------------+-------------------------------+
+type OriginFrame struct {
+	*HeaderFrame
+	Origins []string
+}
+
+func NewOriginFrame(origins []string) *OriginFrame {
+	length := 0
+	for _, origin := range origins {
+		length += 2 + len(origin)
+	}
+
+	return &OriginFrame{
+		HeaderFrame: NewFrameHeader(uint32(length), OriginFrameType, UNSET, 0),
+		Origins:     origins,
+	}
+}
+
+func (f *OriginFrame) Write(w io.Writer) error {
+	buf := f.HeaderFrame.newPayloadBuffer()
+	for _, origin := range f.Origins {
+		binary.Write(buf, binary.BigEndian, uint16(len(origin)))
+		buf.WriteString(origin)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (f *OriginFrame) Read(r io.Reader) error {
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	f.Origins = []string{}
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return f.sizeError()
+		}
+		originLen := int(binary.BigEndian.Uint16(payload[0:2]))
+		payload = payload[2:]
+		if originLen > len(payload) {
+			return f.sizeError()
+		}
+		f.Origins = append(f.Origins, string(payload[:originLen]))
+		payload = payload[originLen:]
+	}
+	return nil
+}
+
+func (f *OriginFrame) Header() *HeaderFrame {
+	return f.HeaderFrame
+}
+
+func (f *OriginFrame) String() string {
+	str := "ORIGIN" + f.HeaderFrame.String()
+	for _, origin := range f.Origins {
+		str += "\n" + origin
+	}
+	return str
+}
+
+// UnknownFrame holds a frame of a type missing from FrameMap.
+// The raw payload is kept so it can be logged or forwarded as is.
+//
+// section 4.1
+// Implementations MUST ignore and discard frames of unknown types.
+type UnknownFrame struct {
+	*HeaderFrame
+	Payload []byte
+}
+
+func (f *UnknownFrame) Write(w io.Writer) error {
+	buf := f.HeaderFrame.newPayloadBuffer()
+	buf.Write(f.Payload)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (f *UnknownFrame) Read(r io.Reader) error {
+	payload, err := f.readPayload(r)
+	if err != nil {
+		return err
+	}
+	f.Payload = payload
+	return nil
 }
 
+func (f *UnknownFrame) Header() *HeaderFrame {
+	return f.HeaderFrame
+}
+
+func (f *UnknownFrame) String() string {
+	return fmt.Sprintf("%v%v\npayload=%d byte", f.Type, f.HeaderFrame.String(), len(f.Payload))
+}
+
+// newFrame returns the frame of the type in hf without its payload
+func newFrame(hf *HeaderFrame) Frame {
+	if newFrame, ok := FrameMap[hf.Type]; ok {
+		return newFrame(hf)
+	}
+	return &UnknownFrame{HeaderFrame: hf}
+}
+
+// ReadFrame reads a frame from r. With a StreamError the rest of the frame
+// is skipped and the frame is returned too, so that the caller can account
+// for the length of skipped DATA.
 func ReadFrame(r io.Reader, settings map[SettingsID]int32) (frame Frame, err error) {
 	hf := new(HeaderFrame)
 	hf.MaxFrameSize = settings[SETTINGS_MAX_FRAME_SIZE]
@@ -626,13 +1196,25 @@ func ReadFrame(r io.Reader, settings map[SettingsID]int32) (frame Frame, err err
 		return nil, err
 	}
 
-	newFrame, ok := FrameMap[hf.Type]
-	if !ok {
-		return nil, fmt.Errorf("unknown type: %v", hf.Type)
+	err = hf.validate()
+	if err != nil {
+		logger.Error("frame.ReadFrame invalid frame size %v", hf)
+		if _, ok := err.(h2.StreamError); ok {
+			// skip the payload without buffering it, the connection stays usable
+			if _, discardErr := io.CopyN(ioutil.Discard, r, int64(hf.Length)); discardErr != nil {
+				return nil, discardErr
+			}
+			return newFrame(hf), err
+		}
+		return nil, err
 	}
+
 	frame = newFrame(hf)
 	err = frame.Read(r)
 	if err != nil {
+		if _, ok := err.(h2.StreamError); ok {
+			return frame, err
+		}
 		return nil, err
 	}
 	return frame, nil
@@ -0,0 +1,391 @@
+package frame
+
+import (
+	"bytes"
+	"minimalist-http2/h2"
+	"testing"
+)
+
+var testSettings = map[SettingsID]int32{
+	SETTINGS_MAX_FRAME_SIZE:       DEFAULT_MAX_FRAME_SIZE,
+	SETTINGS_MAX_HEADER_LIST_SIZE: DEFAULT_MAX_HEADER_LIST_SIZE,
+}
+
+var roundTripCases = []struct {
+	name  string
+	frame Frame
+	wire  []byte
+}{
+	{
+		"DATA",
+		NewDataFrame(DATA_END_STREAM, 1, []byte("hello"), nil),
+		[]byte{
+			0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+			'h', 'e', 'l', 'l', 'o',
+		},
+	},
+	{
+		"DATA padded",
+		NewDataFrame(DATA_PADDED, 3, []byte("hi"), []byte{0, 0, 0}),
+		[]byte{
+			0x00, 0x00, 0x06, 0x00, 0x08, 0x00, 0x00, 0x00, 0x03,
+			0x03, 'h', 'i', 0x00, 0x00, 0x00,
+		},
+	},
+	{
+		"HEADERS",
+		NewHeadersFrame(HEADERS_END_STREAM|HEADERS_END_HEADERS, 1, nil, []byte{0x82, 0x86, 0x84}, nil),
+		[]byte{
+			0x00, 0x00, 0x03, 0x01, 0x05, 0x00, 0x00, 0x00, 0x01,
+			0x82, 0x86, 0x84,
+		},
+	},
+	{
+		"HEADERS padded with priority",
+		NewHeadersFrame(HEADERS_END_HEADERS|HEADERS_PADDED|HEADERS_PRIORITY, 5,
+			&DependencyTree{Exclusive: true, StreamDependency: 3, Weight: 15},
+			[]byte{0x82}, []byte{0, 0}),
+		[]byte{
+			0x00, 0x00, 0x09, 0x01, 0x2c, 0x00, 0x00, 0x00, 0x05,
+			0x02,
+			0x80, 0x00, 0x00, 0x03, 0x0f,
+			0x82,
+			0x00, 0x00,
+		},
+	},
+	{
+		"PRIORITY",
+		NewPriorityFrame(5, false, 3, 255),
+		[]byte{
+			0x00, 0x00, 0x05, 0x02, 0x00, 0x00, 0x00, 0x00, 0x05,
+			0x00, 0x00, 0x00, 0x03, 0xff,
+		},
+	},
+	{
+		"RST_STREAM",
+		NewRstStreamFrame(1, h2.CANCEL_ERROR),
+		[]byte{
+			0x00, 0x00, 0x04, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x08,
+		},
+	},
+	{
+		"SETTINGS",
+		NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+			SETTINGS_INITIAL_WINDOW_SIZE:    65535,
+			SETTINGS_MAX_CONCURRENT_STREAMS: 100,
+		}),
+		[]byte{
+			0x00, 0x00, 0x0c, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x03, 0x00, 0x00, 0x00, 0x64,
+			0x00, 0x04, 0x00, 0x00, 0xff, 0xff,
+		},
+	},
+	{
+		"SETTINGS ack",
+		NewSettingsFrame(SETTINGS_ACK, 0, nil),
+		[]byte{
+			0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00,
+		},
+	},
+	{
+		"PUSH_PROMISE",
+		NewPushPromiseFrame(PUSH_PROMISE_END_HEADERS, 1, 2, []byte{0x82}, nil),
+		[]byte{
+			0x00, 0x00, 0x05, 0x05, 0x04, 0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x02,
+			0x82,
+		},
+	},
+	{
+		"PING ack",
+		NewPingFrame(PING_ACK, 0, []byte("12345678")),
+		[]byte{
+			0x00, 0x00, 0x08, 0x06, 0x01, 0x00, 0x00, 0x00, 0x00,
+			'1', '2', '3', '4', '5', '6', '7', '8',
+		},
+	},
+	{
+		"GOAWAY",
+		NewGoAwayFrame(0, 7, h2.PROTOCOL_ERROR, []byte("bye")),
+		[]byte{
+			0x00, 0x00, 0x0b, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x07,
+			0x00, 0x00, 0x00, 0x01,
+			'b', 'y', 'e',
+		},
+	},
+	{
+		"WINDOW_UPDATE",
+		NewWindowUpdateFrame(0, 1000),
+		[]byte{
+			0x00, 0x00, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x03, 0xe8,
+		},
+	},
+	{
+		"CONTINUATION",
+		NewContinuationFrame(CONTINUAION_END_HEADERS, 1, []byte{0x84}),
+		[]byte{
+			0x00, 0x00, 0x01, 0x09, 0x04, 0x00, 0x00, 0x00, 0x01,
+			0x84,
+		},
+	},
+	{
+		"ALTSVC",
+		NewAltSvcFrame(0, "https://a", `h2=":443"`),
+		[]byte{
+			0x00, 0x00, 0x14, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x09,
+			'h', 't', 't', 'p', 's', ':', '/', '/', 'a',
+			'h', '2', '=', '"', ':', '4', '4', '3', '"',
+		},
+	},
+	{
+		"ORIGIN",
+		NewOriginFrame([]string{"https://a", "https://b"}),
+		[]byte{
+			0x00, 0x00, 0x16, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x09,
+			'h', 't', 't', 'p', 's', ':', '/', '/', 'a',
+			0x00, 0x09,
+			'h', 't', 't', 'p', 's', ':', '/', '/', 'b',
+		},
+	},
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, c := range roundTripCases {
+		var buf bytes.Buffer
+		if err := c.frame.Write(&buf); err != nil {
+			t.Errorf("%s: Write() error %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), c.wire) {
+			t.Errorf("%s: Write()\n got %x\nwant %x", c.name, buf.Bytes(), c.wire)
+		}
+
+		got, err := ReadFrame(bytes.NewReader(c.wire), testSettings)
+		if err != nil {
+			t.Errorf("%s: ReadFrame() error %v", c.name, err)
+			continue
+		}
+		if got.String() != c.frame.String() {
+			t.Errorf("%s: ReadFrame()\n got %v\nwant %v", c.name, got, c.frame)
+		}
+
+		buf.Reset()
+		if err := got.Write(&buf); err != nil {
+			t.Errorf("%s: re-Write() error %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), c.wire) {
+			t.Errorf("%s: re-Write()\n got %x\nwant %x", c.name, buf.Bytes(), c.wire)
+		}
+	}
+}
+
+func TestHeaderFrameString(t *testing.T) {
+	cases := []struct {
+		header *HeaderFrame
+		want   string
+	}{
+		{NewFrameHeader(5, DataFrameType, DATA_END_STREAM, 1), " frame <length=5, flags=0x1, stream_id=1>"},
+		{NewFrameHeader(0, HeadersFrameType, 0x25, 3), " frame <length=0, flags=0x25, stream_id=3>"},
+		{NewFrameHeader(8, PingFrameType, 0x20, 0), " frame <length=8, flags=0x20, stream_id=0>"},
+	}
+	for _, c := range cases {
+		if got := c.header.String(); got != c.want {
+			t.Errorf("String() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestReadHeadersFrameFields(t *testing.T) {
+	wire := roundTripCases[3].wire
+	fr, err := ReadFrame(bytes.NewReader(wire), testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, ok := fr.(*HeadersFrame)
+	if !ok {
+		t.Fatalf("got %T, want *HeadersFrame", fr)
+	}
+	tree := headers.DependencyTree
+	if tree == nil || !tree.Exclusive || tree.StreamDependency != 3 || tree.Weight != 15 {
+		t.Errorf("DependencyTree = %+v", tree)
+	}
+	if headers.PadLength != 2 || !bytes.Equal(headers.HeaderBlockFragment, []byte{0x82}) {
+		t.Errorf("PadLength = %d, HeaderBlockFragment = %x", headers.PadLength, headers.HeaderBlockFragment)
+	}
+}
+
+func TestReadFrameIgnoresReservedBit(t *testing.T) {
+	wire := []byte{
+		0x00, 0x00, 0x04, 0x08, 0x00, 0x80, 0x00, 0x00, 0x01,
+		0x80, 0x00, 0x00, 0x01,
+	}
+	fr, err := ReadFrame(bytes.NewReader(wire), testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Header().StreamID != 1 {
+		t.Errorf("StreamID = %d, want 1", fr.Header().StreamID)
+	}
+	if increment := fr.(*WindowUpdateFrame).WindowSizeIncrement; increment != 1 {
+		t.Errorf("WindowSizeIncrement = %d, want 1", increment)
+	}
+}
+
+func TestReadFrameSizeError(t *testing.T) {
+	cases := []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		{
+			"DATA exceeds SETTINGS_MAX_FRAME_SIZE",
+			append([]byte{0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, make([]byte, 16385)...),
+			h2.StreamError{StreamID: 1, Code: h2.FRAME_SIZE_ERROR},
+		},
+		{
+			"HEADERS exceeds SETTINGS_MAX_FRAME_SIZE",
+			[]byte{0x00, 0x40, 0x01, 0x01, 0x04, 0x00, 0x00, 0x00, 0x01},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"PING not 8 byte",
+			[]byte{0x00, 0x00, 0x04, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"WINDOW_UPDATE not 4 byte",
+			[]byte{0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"RST_STREAM not 4 byte",
+			[]byte{0x00, 0x00, 0x05, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"PRIORITY not 5 byte",
+			[]byte{0x00, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01},
+			h2.StreamError{StreamID: 3, Code: h2.FRAME_SIZE_ERROR},
+		},
+		{
+			"SETTINGS not multiple of 6",
+			[]byte{0x00, 0x00, 0x05, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"SETTINGS ack with payload",
+			[]byte{0x00, 0x00, 0x06, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x64},
+			h2.ConnectionError(h2.FRAME_SIZE_ERROR),
+		},
+		{
+			"DATA pad length exceeds payload",
+			[]byte{0x00, 0x00, 0x03, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x05, 'h', 'i'},
+			h2.ConnectionError(h2.PROTOCOL_ERROR),
+		},
+	}
+
+	for _, c := range cases {
+		_, err := ReadFrame(bytes.NewReader(c.wire), testSettings)
+		if err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestReadFrameSkipsPayloadOnStreamError(t *testing.T) {
+	var wire bytes.Buffer
+	NewPriorityFrame(3, false, 1, 0).HeaderFrame.Write(&wire)
+	wire.Bytes()[2] = 0x04 // corrupt length to 4
+	wire.Write([]byte{0x00, 0x00, 0x00, 0x01})
+	NewPingFrame(UNSET, 0, []byte("12345678")).Write(&wire)
+
+	fr, err := ReadFrame(&wire, testSettings)
+	if err == nil {
+		t.Fatal("expected stream error for PRIORITY")
+	}
+	if fr == nil || fr.Header().StreamID != 3 {
+		t.Errorf("frame = %v, want the header of the PRIORITY", fr)
+	}
+	fr, err = ReadFrame(&wire, testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Header().Type != PingFrameType {
+		t.Errorf("next frame type = %v, want PING", fr.Header().Type)
+	}
+}
+
+func TestReadFrameOversizedData(t *testing.T) {
+	var wire bytes.Buffer
+	wire.Write([]byte{0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	wire.Write(make([]byte, 16385))
+	NewPingFrame(UNSET, 0, []byte("12345678")).Write(&wire)
+
+	fr, err := ReadFrame(&wire, testSettings)
+	if err != (h2.StreamError{StreamID: 1, Code: h2.FRAME_SIZE_ERROR}) {
+		t.Fatalf("err = %v, want stream error FRAME_SIZE_ERROR", err)
+	}
+	if fr.Header().Type != DataFrameType || fr.Header().Length != 16385 {
+		t.Errorf("frame header = %v, want DATA of 16385 byte", fr.Header())
+	}
+	fr, err = ReadFrame(&wire, testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Header().Type != PingFrameType {
+		t.Errorf("next frame type = %v, want PING", fr.Header().Type)
+	}
+}
+
+func TestReadFrameUnknownType(t *testing.T) {
+	wire := []byte{
+		0x00, 0x00, 0x03, 0xfe, 0x01, 0x00, 0x00, 0x00, 0x01,
+		'a', 'b', 'c',
+	}
+	fr, err := ReadFrame(bytes.NewReader(wire), testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, ok := fr.(*UnknownFrame)
+	if !ok {
+		t.Fatalf("got %T, want *UnknownFrame", fr)
+	}
+	if !bytes.Equal(unknown.Payload, []byte("abc")) {
+		t.Errorf("Payload = %q, want %q", unknown.Payload, "abc")
+	}
+
+	var buf bytes.Buffer
+	if err := unknown.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), wire) {
+		t.Errorf("Write()\n got %x\nwant %x", buf.Bytes(), wire)
+	}
+}
+
+type testExtensionFrame struct {
+	UnknownFrame
+}
+
+func TestRegisterFrameType(t *testing.T) {
+	const extensionType FrameType = 0xf0
+	RegisterFrameType(extensionType, func(fh *HeaderFrame) Frame {
+		return &testExtensionFrame{UnknownFrame{HeaderFrame: fh}}
+	})
+	defer delete(FrameMap, extensionType)
+
+	wire := []byte{0x00, 0x00, 0x00, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00}
+	fr, err := ReadFrame(bytes.NewReader(wire), testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fr.(*testExtensionFrame); !ok {
+		t.Errorf("got %T, want *testExtensionFrame", fr)
+	}
+}
@@ -0,0 +1,78 @@
+package h2
+
+import "fmt"
+
+// An ErrCode is an unsigned 32-bit error code as defined in the HTTP/2 specification.
+// You can see https://httpwg.org/specs/rfc7540.html#ErrorHandler
+type ErrCode uint32
+
+const (
+	NO_ERROR                 ErrCode = 0x0
+	PROTOCOL_ERROR           ErrCode = 0x1 // protocol error detected
+	INTERNAL_ERROR           ErrCode = 0x2 // implementation fault
+	FLOW_CONTROL_ERROR       ErrCode = 0x3 // Flow-control limits exceeded
+	SETTINGS_TIMEOUT_ERROR   ErrCode = 0x4 // Setting not acknowledged
+	STREAM_CLOSED_ERROR      ErrCode = 0x5 // Frame received for closed stream
+	FRAME_SIZE_ERROR         ErrCode = 0x6 // Frame size incorrect
+	REFUSED_STREAM_ERROR     ErrCode = 0x7 // Stream not processed
+	CANCEL_ERROR             ErrCode = 0x8 // Stream cancelled
+	COMPRESSION_ERROR        ErrCode = 0x9 // Compression state not updated
+	CONNECT_ERROR            ErrCode = 0xa // Tcp connection error for CONNECT method
+	ENHANCE_YOUR_CALM_ERROR  ErrCode = 0xb // Processing capacity exceeded
+	INDEQUATE_SECURITY_ERROR ErrCode = 0xc // Negotiated TLS parameters not acceptable
+	HTTP_1_1_REQUIRED_ERROR  ErrCode = 0xd // Use HTTP/1/1 fpr the request
+)
+
+func (e ErrCode) String() string {
+	codes := []string{
+		"NO_ERROR",
+		"PROTOCOL_ERROR",
+		"INTERNAL_ERROR",
+		"FLOW_CONTROL_ERROR",
+		"SETTINGS_TIMEOUT",
+		"STREAM_CLOSED",
+		"FRAME_SIZE_ERROR",
+		"REFUSED_STREAM",
+		"CANCEL",
+		"COMPRESSION_ERROR",
+		"CONNECT_ERROR",
+		"ENHANCE_YOUR_CALM",
+		"INADEQUATE_SECURITY",
+		"HTTP_1_1_REQUIRED",
+	}
+	// a peer may send codes not defined yet, section 7
+	if uint32(e) >= uint32(len(codes)) {
+		return fmt.Sprintf("UNKNOWN(%#x)", uint32(e))
+	}
+	return codes[uint32(e)]
+}
+
+// ConnectionError is an error that results in the termination of the entire connection
+type ConnectionError ErrCode
+
+func (c ConnectionError) Error() string {
+	return fmt.Sprintf("connection error: %s", ErrCode(c))
+}
+
+// StreamError is an error that only effects one stream within an HTTP/2 connection.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+}
+
+func (s StreamError) Error() string {
+	return fmt.Sprintf("stream error: streamID %d; %v", s.StreamID, s.Code)
+}
+
+type H2Error struct {
+	ErrCode             ErrCode
+	AdditionalDebugData string
+}
+
+func (e H2Error) String() string {
+	return fmt.Sprintf("%v(%v)", e.ErrCode, e.AdditionalDebugData)
+}
+
+func (e H2Error) Error() string {
+	return e.ErrCode.String()
+}
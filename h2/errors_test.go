@@ -0,0 +1,23 @@
+package h2
+
+import "testing"
+
+func TestErrCodeString(t *testing.T) {
+	cases := []struct {
+		code ErrCode
+		want string
+	}{
+		{NO_ERROR, "NO_ERROR"},
+		{HTTP_1_1_REQUIRED_ERROR, "HTTP_1_1_REQUIRED"},
+		{0xe, "UNKNOWN(0xe)"},
+		{0xffffffff, "UNKNOWN(0xffffffff)"},
+	}
+	for _, c := range cases {
+		if got := c.code.String(); got != c.want {
+			t.Errorf("ErrCode(%d).String() = %q, want %q", uint32(c.code), got, c.want)
+		}
+		if got := (H2Error{ErrCode: c.code}).Error(); got != c.want {
+			t.Errorf("H2Error{%d}.Error() = %q, want %q", uint32(c.code), got, c.want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package hpack
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/Jxck/hpack/huffman"
 	. "github.com/Jxck/logger"
 	"github.com/Jxck/swrap"
@@ -12,161 +15,281 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// ErrTruncated is returned when a header block ends inside a representation
+var ErrTruncated = errors.New("hpack: truncated header block")
+
+// ErrHeaderListSize is returned when the header list is larger than
+// Decoder.MaxHeaderListSize. The header block is decoded to the end,
+// so the dynamic table is still in sync with the peer.
+var ErrHeaderListSize = errors.New("hpack: header list too large")
+
+// ErrInvalidHuffman is returned for a Huffman encoded string
+// with EOS or with invalid padding
+var ErrInvalidHuffman = errors.New("hpack: invalid huffman code")
+
+// Decoder decodes header blocks with its own dynamic table,
+// which is driven by the encoder of the peer.
+// Header blocks must be decoded in the order they are received.
+type Decoder struct {
+	HT *DynamicTable
+	// SETTINGS_HEADER_TABLE_SIZE of this endpoint,
+	// the peer can not make the table larger than this
+	maxSizeLimit uint32
+	// SETTINGS_MAX_HEADER_LIST_SIZE of this endpoint, no limit if zero.
+	// Fields over it are not emitted, section 10.5.1
+	MaxHeaderListSize uint32
+}
+
+func NewDecoder(SETTINGS_HEADER_TABLE_SIZE uint32) *Decoder {
+	return &Decoder{
+		HT:           NewDynamicTable(SETTINGS_HEADER_TABLE_SIZE),
+		maxSizeLimit: SETTINGS_HEADER_TABLE_SIZE,
+	}
+}
+
+// SetMaxDynamicTableSize applies SETTINGS_HEADER_TABLE_SIZE of this endpoint
+func (d *Decoder) SetMaxDynamicTableSize(size uint32) {
+	d.maxSizeLimit = size
+	if d.HT.DYNAMIC_TABLE_SIZE > size {
+		d.changeSize(size)
+	}
+}
+
+// Decode returns the header list of wire. The error is a decoding error,
+// after which the dynamic table is not in sync with the peer.
+func (d *Decoder) Decode(wire []byte) (headerList HeaderList, err error) {
+	frames, err := Decode(wire)
+	if err != nil {
+		return nil, err
+	}
+
+	headerList = *NewHeaderList()
+	var size uint64
+	emit := func(headerField *HeaderField) {
+		size += uint64(headerField.Size())
+		if d.MaxHeaderListSize > 0 && size > uint64(d.MaxHeaderListSize) {
+			return
+		}
+		headerList.Emit(headerField)
+	}
+	for _, frame := range frames {
+		switch f := frame.(type) {
+		case *IndexedHeader:
+			headerField, err := d.field(f.Index)
+			if err != nil {
+				return nil, err
+			}
+			Trace("indexed %d = %v", f.Index, headerField)
+			emit(NewHeaderField(headerField.Name, headerField.Value))
+		case *IndexedLiteral:
+			// the name is taken before the new entry evicts it
+			headerField, err := d.field(f.Index)
+			if err != nil {
+				return nil, err
+			}
+			d.index(f.Indexing, NewHeaderField(headerField.Name, f.ValueString), emit)
+		case *StringLiteral:
+			d.index(f.Indexing, NewHeaderField(f.NameString, f.ValueString), emit)
+		case *DynamicTableSizeUpdate:
+			// section 4.2
+			if size > 0 {
+				return nil, fmt.Errorf("hpack: dynamic table size update after header field")
+			}
+			if f.MaxSize > d.maxSizeLimit {
+				return nil, fmt.Errorf("hpack: dynamic table size update %d over %d", f.MaxSize, d.maxSizeLimit)
+			}
+			Debug("dynamic table size update %d", f.MaxSize)
+			d.changeSize(f.MaxSize)
+		default:
+			return nil, fmt.Errorf("hpack: unknown representation %T", f)
+		}
+	}
+	Trace("decoder dynamic table %v", d.HT)
+	if d.MaxHeaderListSize > 0 && size > uint64(d.MaxHeaderListSize) {
+		return nil, ErrHeaderListSize
+	}
+	return headerList, nil
+}
+
+// field returns the entry at index of the static table
+// followed by the dynamic table, section 2.3.3
+func (d *Decoder) field(index uint32) (*HeaderField, error) {
+	if index == 0 {
+		return nil, fmt.Errorf("hpack: index 0 is not used")
+	}
+	i := int(index)
+	if i <= STATIC_HEADER_TABLE_SIZE {
+		return &StaticTable[i-1], nil
+	}
+	i -= STATIC_HEADER_TABLE_SIZE + 1
+	if i >= d.HT.Len() {
+		return nil, fmt.Errorf("hpack: index %d out of dynamic table", index)
+	}
+	return d.HT.HeaderFields[i], nil
+}
+
+// index emits headerField and adds it to the dynamic table
+// for incremental indexing
+func (d *Decoder) index(indexing Indexing, headerField *HeaderField, emit func(*HeaderField)) {
+	emit(headerField)
+	if indexing == WITH {
+		d.HT.Push(headerField)
+		d.evict()
+	}
+}
+
+func (d *Decoder) changeSize(size uint32) {
+	d.HT.DYNAMIC_TABLE_SIZE = size
+	d.evict()
+}
+
+// removing entry from bottom
+// until the table fits in its size
+func (d *Decoder) evict() {
+	for d.HT.Size() > d.HT.DYNAMIC_TABLE_SIZE {
+		removed := d.HT.Remove(d.HT.Len() - 1)
+		Debug("decoder evicts %v", removed)
+	}
+}
+
 // Decode Wire byte seq to Slice of Frames
-func Decode(wire []byte) (frames []Frame) {
+func Decode(wire []byte) (frames []Frame, err error) {
 	buf := swrap.Make(wire)
 	for buf.Len() > 0 {
-		frames = append(frames, DecodeHeader(buf))
+		frame, err := DecodeHeader(buf)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
 	}
-	return frames
+	return frames, nil
 }
 
 // Decode single Frame from buffer and return it
-func DecodeHeader(buf *swrap.SWrap) Frame {
+func DecodeHeader(buf *swrap.SWrap) (Frame, error) {
 	// check first byte
 	types := (*buf)[0]
 	Trace("types = %v", types)
 	if types >= 0x80 { // 1xxx xxxx
 		Debug("Indexed Header Representation")
 
-		index := DecodePrefixedInteger(buf, 7)
-		Trace("Indexed = %v", index)
-		frame := NewIndexedHeader(index)
-
-		if index == 0 {
-			// TODO: Decoding Error
-			// log.Fatal("Decoding Error: The index value of 0 is not used.")
+		index, err := DecodePrefixedInteger(buf, 7)
+		if err != nil {
+			return nil, err
 		}
-		return frame
+		Trace("Indexed = %v", index)
+		return NewIndexedHeader(index), nil
 	}
-	if types == 0 { // 0000 0000
-		Debug("StringLiteral (indexing = WITHOUT)")
-
-		// remove first byte defines type
-		buf.Shift()
-
+	if types == 0 || types == 0x10 || types == 0x40 { // 0000 0000, 0001 0000, 0100 0000
 		indexing := WITHOUT
-		name := DecodeLiteral(buf)
-		Trace("StringLiteral name = %v", name)
-		value := DecodeLiteral(buf)
-		Trace("StringLiteral value = %v", value)
-		frame := NewStringLiteral(indexing, name, value)
-		return frame
-	}
-	if types == 0x10 { // 0001 0000
-		Debug("StringLiteral (indexing = NEVER)")
+		switch types {
+		case 0x10:
+			indexing = NEVER
+		case 0x40:
+			indexing = WITH
+		}
+		Debug("StringLiteral (indexing = %v)", indexing)
 
 		// remove first byte defines type
 		buf.Shift()
 
-		indexing := NEVER
-		name := DecodeLiteral(buf)
+		name, err := DecodeLiteral(buf)
+		if err != nil {
+			return nil, err
+		}
 		Trace("StringLiteral name = %v", name)
-		value := DecodeLiteral(buf)
+		value, err := DecodeLiteral(buf)
+		if err != nil {
+			return nil, err
+		}
 		Trace("StringLiteral value = %v", value)
-		frame := NewStringLiteral(indexing, name, value)
-		return frame
+		return NewStringLiteral(indexing, name, value), nil
 	}
-	if types == 0x40 { // 0100 0000
-		Debug("StringLiteral (indexing = WITH)")
-
-		// remove first byte defines type
-		buf.Shift()
+	if types&0xe0 == 0x20 { // 001x xxxx & 1110 0000 == 0010 0000
+		Debug("Header Table Size Update")
 
-		indexing := WITH
-		name := DecodeLiteral(buf)
-		Trace("StringLiteral name = %v", name)
-		value := DecodeLiteral(buf)
-		Trace("StringLiteral value = %v", value)
-		frame := NewStringLiteral(indexing, name, value)
-		return frame
+		maxSize, err := DecodePrefixedInteger(buf, 5)
+		if err != nil {
+			return nil, err
+		}
+		return NewDynamicTableSizeUpdate(maxSize), nil
 	}
-	if types&0xc0 == 0x40 { // 01xx xxxx & 1100 0000 == 0100 0000
-		Debug("IndexedLiteral (indexing = WITH)")
 
-		indexing := WITH
-		index := DecodePrefixedInteger(buf, 6)
-		Trace("IndexedLiteral index = %v", index)
-		value := DecodeLiteral(buf)
-		Trace("IndexedLiteral value = %v", value)
-		frame := NewIndexedLiteral(indexing, index, value)
-		return frame
+	var indexing Indexing
+	var N uint8
+	switch {
+	case types&0xc0 == 0x40: // 01xx xxxx & 1100 0000 == 0100 0000
+		indexing, N = WITH, 6
+	case types&0xf0 == 0: // 0000 xxxx & 1111 0000 == 0000 0000
+		indexing, N = WITHOUT, 4
+	default: // 0001 xxxx
+		indexing, N = NEVER, 4
 	}
-	if types&0xf0 == 0 { // 0000 xxxx & 1111 0000 == 0000 0000
-		Debug("IndexedLiteral (indexing = WITHOUT)")
+	Debug("IndexedLiteral (indexing = %v)", indexing)
 
-		indexing := WITHOUT
-		index := DecodePrefixedInteger(buf, 4)
-		Trace("IndexedLiteral index = %v", index)
-		value := DecodeLiteral(buf)
-		Trace("IndexedLiteral value = %v", value)
-		frame := NewIndexedLiteral(indexing, index, value)
-		return frame
-	}
-	if types&0xf0 == 0x10 { // 0000 xxxx & 1111 0000 == 0001 0000
-		Debug("IndexedLiteral (indexing = NEVER)")
-
-		indexing := NEVER
-		index := DecodePrefixedInteger(buf, 4)
-		Trace("IndexedLiteral index = %v", index)
-		value := DecodeLiteral(buf)
-		Trace("IndexedLiteral value = %v", value)
-		frame := NewIndexedLiteral(indexing, index, value)
-		return frame
+	index, err := DecodePrefixedInteger(buf, N)
+	if err != nil {
+		return nil, err
 	}
-	if types&0xe0 == 0x20 { // 001x xxxx & 1110 0000 == 0010 0000
-		Debug("Header Table Size Update")
-
-		maxSize := DecodePrefixedInteger(buf, 5)
-		frame := NewDynamicTableSizeUpdate(maxSize)
-		return frame
+	Trace("IndexedLiteral index = %v", index)
+	value, err := DecodeLiteral(buf)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	Trace("IndexedLiteral value = %v", value)
+	return NewIndexedLiteral(indexing, index, value), nil
 }
 
 // read N prefixed Integer from buffer as uint32
-func DecodePrefixedInteger(buf *swrap.SWrap, N uint8) uint32 {
-	tmp := integer_representation.ReadPrefixedInteger(buf, N)
+func DecodePrefixedInteger(buf *swrap.SWrap, N uint8) (uint32, error) {
+	tmp, err := integer_representation.ReadPrefixedInteger(buf, N)
+	if err != nil {
+		return 0, err
+	}
 	return integer_representation.Decode(tmp, N)
 }
 
 // read n byte from buffer as string
-func DecodeString(buf *swrap.SWrap, n uint32) string {
-	valueBytes := make([]byte, 0, n)
-	for i := n; i > 0; i-- {
-		valueBytes = append(valueBytes, buf.Shift())
+func DecodeString(buf *swrap.SWrap, n uint32) (string, error) {
+	if uint32(buf.Len()) < n {
+		return "", ErrTruncated
 	}
-	return string(valueBytes)
+	value := string((*buf)[:n])
+	*buf = (*buf)[n:]
+	return value, nil
 }
 
-func DecodeLiteral(buf *swrap.SWrap) (value string) {
-	// 最初のバイトを取り出す
-	first := (*buf)[0]
-
-	// 最初の 1bit をみて huffman かどうか取得
-	huffmanEncoded := (first&0x80 == 0x80)
+func DecodeLiteral(buf *swrap.SWrap) (value string, err error) {
+	if buf.Len() == 0 {
+		return "", ErrTruncated
+	}
 
+	// the first bit is huffman flag,
+	// masked when reading the length
+	huffmanEncoded := ((*buf)[0]&0x80 == 0x80)
 	Trace("huffman = %t", huffmanEncoded)
-	if huffmanEncoded {
-		// 最初のバイトから 1 bit 目を消す
-		(*buf)[0] = first & 127
-
-		// ここで prefixed Integer 7 で読む。
-		b := DecodePrefixedInteger(buf, 7)
-		Trace("Literal Length = %v, buf size=%v", b, buf.Len())
-
-		// その長さの分だけバイト値を取り出す
-		code := make([]byte, 0)
-		for ; b > 0; b-- {
-			code = append(code, buf.Shift())
-		}
 
-		// ハフマンデコード
-		value = string(huffman.Decode(code))
-		Trace("decoded = %v", value)
-	} else {
-		valueLength := DecodePrefixedInteger(buf, 7)
-		value = DecodeString(buf, valueLength)
+	length, err := DecodePrefixedInteger(buf, 7)
+	if err != nil {
+		return "", err
+	}
+	Trace("Literal Length = %v, buf size=%v", length, buf.Len())
+
+	value, err = DecodeString(buf, length)
+	if err != nil || !huffmanEncoded {
+		return value, err
+	}
+	return huffmanDecode([]byte(value))
+}
+
+// huffmanDecode decodes code, which must end with the most significant
+// bits of EOS as padding shorter than 8 bits and must not contain EOS,
+// section 5.2. Valid code is exactly what encoding the result gives.
+func huffmanDecode(code []byte) (string, error) {
+	decoded := huffman.Decode(code)
+	if !bytes.Equal(huffman.Encode(decoded), code) {
+		return "", ErrInvalidHuffman
 	}
-	return value
+	Trace("decoded = %s", decoded)
+	return string(decoded), nil
 }
@@ -0,0 +1,142 @@
+package hpack
+
+import (
+	"minimalist-http2/hpack/integer_representation"
+	"testing"
+)
+
+// a literal header field without indexing of the new name "a"
+// followed by a huffman encoded value of the given code
+func literalHuffman(code ...byte) []byte {
+	wire := []byte{0x00, 0x01, 'a', 0x80 | byte(len(code))}
+	return append(wire, code...)
+}
+
+func TestDecodeValid(t *testing.T) {
+	d := NewDecoder(4096)
+	headerList, err := d.Decode(literalHuffman(0x1f)) // "a" with 3 bit padding
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headerList) != 1 || headerList[0].Name != "a" || headerList[0].Value != "a" {
+		t.Errorf("Decode() = %v, want a: a", headerList)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	cases := []struct {
+		name string
+		wire []byte
+		err  error // nil for any error
+	}{
+		{
+			"index 0",
+			[]byte{0x80},
+			nil,
+		},
+		{
+			"index past the end of the table",
+			[]byte{0xbe}, // 62 with an empty dynamic table
+			nil,
+		},
+		{
+			"integer overflow",
+			[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x0f},
+			integer_representation.ErrOverflow,
+		},
+		{
+			"integer truncated",
+			[]byte{0xff, 0xff},
+			integer_representation.ErrTruncated,
+		},
+		{
+			"huffman padding longer than 7 bit",
+			literalHuffman(0x1f, 0xff),
+			ErrInvalidHuffman,
+		},
+		{
+			"huffman padding not all ones",
+			literalHuffman(0x18),
+			ErrInvalidHuffman,
+		},
+		{
+			"huffman with EOS",
+			literalHuffman(0x1f, 0xff, 0xff, 0xff, 0xe3), // "a" EOS "a"
+			ErrInvalidHuffman,
+		},
+		{
+			"string literal truncated",
+			[]byte{0x00, 0x05, 'a', 'b'},
+			ErrTruncated,
+		},
+		{
+			"string literal without value",
+			[]byte{0x00, 0x01, 'a'},
+			ErrTruncated,
+		},
+	}
+
+	for _, c := range cases {
+		d := NewDecoder(4096)
+		_, err := d.Decode(c.wire)
+		if err == nil {
+			t.Errorf("%s: got no error", c.name)
+			continue
+		}
+		if c.err != nil && err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestDecodeHeaderListSize(t *testing.T) {
+	d := NewDecoder(4096)
+	d.MaxHeaderListSize = 40
+
+	// two fields of size 34 with incremental indexing
+	wire := []byte{
+		0x40, 0x01, 'a', 0x01, 'b',
+		0x40, 0x01, 'c', 0x01, 'd',
+	}
+	if _, err := d.Decode(wire); err != ErrHeaderListSize {
+		t.Fatalf("got %v, want %v", err, ErrHeaderListSize)
+	}
+	// the block is decoded to the end to keep the table in sync
+	if d.HT.Len() != 2 {
+		t.Errorf("dynamic table has %d entries, want 2", d.HT.Len())
+	}
+
+	// one field fits
+	headerList, err := d.Decode([]byte{0xbe}) // "c: d" indexed
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headerList) != 1 || headerList[0].Name != "c" || headerList[0].Value != "d" {
+		t.Errorf("Decode() = %v, want c: d", headerList)
+	}
+}
+
+func TestDecodeDynamicTableSizeUpdate(t *testing.T) {
+	cases := []struct {
+		name  string
+		wire  []byte
+		valid bool
+	}{
+		{"up to the maximum", []byte{0x3f, 0xe1, 0x1f}, true},           // 4096
+		{"over the maximum", []byte{0x3f, 0xe1, 0x3f}, false},           // 8192
+		{"after a header field", []byte{0x82, 0x3f, 0xe1, 0x1f}, false}, // section 4.2
+	}
+
+	// any error other than ErrHeaderListSize
+	// is a COMPRESSION_ERROR of the connection
+	for _, c := range cases {
+		d := NewDecoder(4096)
+		_, err := d.Decode(c.wire)
+		if c.valid && err != nil {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		if !c.valid && (err == nil || err == ErrHeaderListSize) {
+			t.Errorf("%s: got %v, want decoding error", c.name, err)
+		}
+	}
+}
@@ -5,8 +5,134 @@ import (
 	"github.com/Jxck/logger"
 	"github.com/Jxck/swrap"
 	"minimalist-http2/hpack/integer_representation"
+	"sync"
 )
 
+// Encoder encodes header lists into header blocks with its own
+// dynamic table, which the decoder of the peer builds the same way.
+// Header blocks must be sent in the order they are encoded.
+type Encoder struct {
+	mu sync.Mutex
+	HT *DynamicTable
+	// the table does not grow over this,
+	// even when the peer allows a larger one
+	maxSizeLimit uint32
+	// smallest size since the last header block, when the size changed,
+	// signaled with the last size at the start of the next header block
+	minSize     uint32
+	sizeUpdated bool
+}
+
+func NewEncoder(SETTINGS_HEADER_TABLE_SIZE uint32) *Encoder {
+	return &Encoder{
+		HT:           NewDynamicTable(SETTINGS_HEADER_TABLE_SIZE),
+		maxSizeLimit: SETTINGS_HEADER_TABLE_SIZE,
+	}
+}
+
+// SetMaxDynamicTableSize applies SETTINGS_HEADER_TABLE_SIZE of the peer,
+// up to the initial size of the table
+func (e *Encoder) SetMaxDynamicTableSize(size uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if size > e.maxSizeLimit {
+		size = e.maxSizeLimit
+	}
+	if size == e.HT.DYNAMIC_TABLE_SIZE {
+		return
+	}
+	if !e.sizeUpdated || size < e.minSize {
+		e.minSize = size
+	}
+	e.sizeUpdated = true
+	e.HT.DYNAMIC_TABLE_SIZE = size
+	e.evict(0)
+}
+
+// Encode returns the header block of headerList. Fields in the static
+// or dynamic table are indexed, others are added to the dynamic table
+// with incremental indexing when they fit in it.
+func (e *Encoder) Encode(headerList HeaderList) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var buf swrap.SWrap
+
+	// section 4.2 size changes are signaled at the start of the next block
+	if e.sizeUpdated {
+		if e.minSize < e.HT.DYNAMIC_TABLE_SIZE {
+			buf.Merge(*NewDynamicTableSizeUpdate(e.minSize).Encode())
+		}
+		buf.Merge(*NewDynamicTableSizeUpdate(e.HT.DYNAMIC_TABLE_SIZE).Encode())
+		e.sizeUpdated = false
+	}
+
+	for _, h := range headerList {
+		index, nameOnly := e.search(h)
+		if index > 0 && !nameOnly {
+			buf.Merge(*NewIndexedHeader(index).Encode())
+			continue
+		}
+
+		indexing := WITH
+		if h.Size() > e.HT.DYNAMIC_TABLE_SIZE {
+			indexing = WITHOUT
+		}
+
+		if index > 0 {
+			buf.Merge(*NewIndexedLiteral(indexing, index, h.Value).EncodeHuffman())
+		} else {
+			buf.Merge(*NewStringLiteral(indexing, h.Name, h.Value).EncodeHuffman())
+		}
+
+		if indexing == WITH {
+			e.evict(h.Size())
+			e.HT.Push(NewHeaderField(h.Name, h.Value))
+		}
+	}
+
+	logger.Trace("encoder dynamic table %v", e.HT)
+	return buf.Bytes()
+}
+
+// search returns the index of the field which matches h in the static
+// table, then in the dynamic table. nameOnly is true when only the name
+// matches, and index is 0 when nothing matches.
+func (e *Encoder) search(h *HeaderField) (index uint32, nameOnly bool) {
+	for i, hf := range StaticTable {
+		if hf.Name != h.Name {
+			continue
+		}
+		if hf.Value == h.Value {
+			return uint32(i + 1), false
+		}
+		if index == 0 {
+			index, nameOnly = uint32(i+1), true
+		}
+	}
+	for i, hf := range e.HT.HeaderFields {
+		if hf.Name != h.Name {
+			continue
+		}
+		if hf.Value == h.Value {
+			return uint32(STATIC_HEADER_TABLE_SIZE + i + 1), false
+		}
+		if index == 0 {
+			index, nameOnly = uint32(STATIC_HEADER_TABLE_SIZE+i+1), true
+		}
+	}
+	return index, nameOnly
+}
+
+// evict removes the oldest entries until size fits in the table,
+// section 4.4
+func (e *Encoder) evict(size uint32) {
+	for e.HT.Len() > 0 && e.HT.Size()+size > e.HT.DYNAMIC_TABLE_SIZE {
+		removed := e.HT.Remove(e.HT.Len() - 1)
+		logger.Trace("encoder evicts %v", removed)
+	}
+}
+
 func (frame *IndexedHeader) Encode() (buf *swrap.SWrap) {
 	buf = swrap.Make(integer_representation.Encode(frame.Index, 7))
 	(*buf)[0] += 0x80
@@ -20,12 +146,12 @@ func (frame *IndexedLiteral) Encode() (buf *swrap.SWrap) {
 	switch frame.Indexing {
 	case WITH:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 6))
-		(*buf)[0] += 0x20
+		(*buf)[0] += 0x40 // 01xx xxxx
 	case WITHOUT:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 4))
 	case NEVER:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 4))
-		(*buf)[0] += 0x8
+		(*buf)[0] += 0x10 // 0001 xxxx
 	}
 
 	// No Huffman
@@ -39,12 +165,12 @@ func (frame *IndexedLiteral) EncodeHuffman() (buf *swrap.SWrap) {
 	switch frame.Indexing {
 	case WITH:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 6))
-		(*buf)[0] += 0x20
+		(*buf)[0] += 0x40 // 01xx xxxx
 	case WITHOUT:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 4))
 	case NEVER:
 		buf = swrap.Make(integer_representation.Encode(frame.Index, 4))
-		(*buf)[0] += 0x8
+		(*buf)[0] += 0x10 // 0001 xxxx
 	}
 
 	var encoded, length []byte
@@ -113,8 +239,7 @@ func (frame *StringLiteral) EncodeHuffman() (buf *swrap.SWrap) {
 }
 
 func (frame *DynamicTableSizeUpdate) Encode() (buf *swrap.SWrap) {
-	buf = new(swrap.SWrap)
-	buf.Add(0x20) // 0010 0000
-	buf.Merge(integer_representation.Encode(frame.MaxSize, 4))
+	buf = swrap.Make(integer_representation.Encode(frame.MaxSize, 5))
+	(*buf)[0] += 0x20 // 001x xxxx
 	return buf
 }
@@ -0,0 +1,142 @@
+package hpack
+
+import (
+	"fmt"
+	"testing"
+)
+
+func fields(nameValues ...string) HeaderList {
+	var headerList HeaderList
+	for i := 0; i < len(nameValues); i += 2 {
+		headerList = append(headerList, NewHeaderField(nameValues[i], nameValues[i+1]))
+	}
+	return headerList
+}
+
+// entries returns the dynamic table as "name: value", the newest first
+func entries(ht *DynamicTable) []string {
+	var str []string
+	for _, hf := range ht.HeaderFields {
+		str = append(str, hf.Name+": "+hf.Value)
+	}
+	return str
+}
+
+// roundTrip encodes headerList and decodes the header block, which
+// must give the same list and leave both tables with want and size.
+// It returns the representations of the header block.
+func roundTrip(t *testing.T, e *Encoder, d *Decoder, headerList HeaderList, want []string, size uint32) []Frame {
+	t.Helper()
+	wire := e.Encode(headerList)
+	// Decode rewrites the wire it's given
+	frames, err := Decode(append([]byte(nil), wire...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := d.Decode(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(headerList) {
+		t.Errorf("decoded %v, want %v", decoded, headerList)
+	}
+	for name, ht := range map[string]*DynamicTable{"encoder": e.HT, "decoder": d.HT} {
+		if fmt.Sprint(entries(ht)) != fmt.Sprint(want) {
+			t.Errorf("%s table %v, want %v", name, entries(ht), want)
+		}
+		if ht.Size() != size {
+			t.Errorf("%s table size %d, want %d", name, ht.Size(), size)
+		}
+	}
+	return frames
+}
+
+func TestEncodeIndexing(t *testing.T) {
+	e, d := NewEncoder(4096), NewDecoder(4096)
+
+	// static table, section 2.3.1
+	frames := roundTrip(t, e, d, fields(":method", "GET"), nil, 0)
+	if f, ok := frames[0].(*IndexedHeader); !ok || f.Index != 2 {
+		t.Errorf("representation %v, want indexed 2", frames[0])
+	}
+
+	// new name with incremental indexing, section 6.2.1
+	frames = roundTrip(t, e, d, fields("custom-key", "custom-value"),
+		[]string{"custom-key: custom-value"}, 54)
+	if f, ok := frames[0].(*StringLiteral); !ok || f.Indexing != WITH {
+		t.Errorf("representation %v, want literal with incremental indexing", frames[0])
+	}
+
+	// name of the static table
+	frames = roundTrip(t, e, d, fields(":path", "/sample"),
+		[]string{":path: /sample", "custom-key: custom-value"}, 54+44)
+	if f, ok := frames[0].(*IndexedLiteral); !ok || f.Index != 4 || f.Indexing != WITH {
+		t.Errorf("representation %v, want literal of index 4 with incremental indexing", frames[0])
+	}
+
+	// dynamic table, section 2.3.2
+	frames = roundTrip(t, e, d, fields("custom-key", "custom-value", ":path", "/sample"),
+		[]string{":path: /sample", "custom-key: custom-value"}, 54+44)
+	if f, ok := frames[0].(*IndexedHeader); !ok || f.Index != 63 {
+		t.Errorf("representation %v, want indexed 63", frames[0])
+	}
+	if f, ok := frames[1].(*IndexedHeader); !ok || f.Index != 62 {
+		t.Errorf("representation %v, want indexed 62", frames[1])
+	}
+}
+
+func TestEncodeEviction(t *testing.T) {
+	e, d := NewEncoder(100), NewDecoder(100)
+
+	roundTrip(t, e, d, fields("a", "1", "b", "2"), []string{"b: 2", "a: 1"}, 68)
+
+	// the oldest entry is evicted for the new one, section 4.4
+	roundTrip(t, e, d, fields("c", "3"), []string{"c: 3", "b: 2"}, 68)
+
+	// a field larger than the table is not indexed and the table is kept
+	large := fields("d", string(make([]byte, 100)))
+	frames := roundTrip(t, e, d, large, []string{"c: 3", "b: 2"}, 68)
+	if f, ok := frames[0].(*StringLiteral); !ok || f.Indexing != WITHOUT {
+		t.Errorf("representation %v, want literal without indexing", frames[0])
+	}
+}
+
+func TestEncodeDynamicTableSizeUpdate(t *testing.T) {
+	e, d := NewEncoder(4096), NewDecoder(4096)
+	roundTrip(t, e, d, fields("a", "1", "b", "2"), []string{"b: 2", "a: 1"}, 68)
+
+	// shrinking evicts entries, and the next block starts with the size
+	e.SetMaxDynamicTableSize(40)
+	frames := roundTrip(t, e, d, fields(":method", "GET"), []string{"b: 2"}, 34)
+	if f, ok := frames[0].(*DynamicTableSizeUpdate); !ok || f.MaxSize != 40 {
+		t.Errorf("representation %v, want size update 40", frames[0])
+	}
+	if d.HT.DYNAMIC_TABLE_SIZE != 40 {
+		t.Errorf("decoder table max size %d, want 40", d.HT.DYNAMIC_TABLE_SIZE)
+	}
+
+	// a shrink followed by a grow is signaled with the smallest size,
+	// then the final one, section 4.2
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(8192) // limited to the initial size
+	frames = roundTrip(t, e, d, fields("c", "3"), []string{"c: 3"}, 34)
+	if len(frames) != 3 {
+		t.Fatalf("representations %v, want 2 size updates and a literal", frames)
+	}
+	if f, ok := frames[0].(*DynamicTableSizeUpdate); !ok || f.MaxSize != 0 {
+		t.Errorf("representation %v, want size update 0", frames[0])
+	}
+	if f, ok := frames[1].(*DynamicTableSizeUpdate); !ok || f.MaxSize != 4096 {
+		t.Errorf("representation %v, want size update 4096", frames[1])
+	}
+	if d.HT.DYNAMIC_TABLE_SIZE != 4096 {
+		t.Errorf("decoder table max size %d, want 4096", d.HT.DYNAMIC_TABLE_SIZE)
+	}
+
+	// no update without a change
+	e.SetMaxDynamicTableSize(4096)
+	frames = roundTrip(t, e, d, fields("c", "3"), []string{"c: 3"}, 34)
+	if _, ok := frames[0].(*IndexedHeader); !ok || len(frames) != 1 {
+		t.Errorf("representations %v, want indexed only", frames)
+	}
+}
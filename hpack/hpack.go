@@ -1 +1,3 @@
 package hpack
+
+var STATIC_HEADER_TABLE_SIZE = len(StaticTable)
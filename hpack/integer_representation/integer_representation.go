@@ -1,10 +1,17 @@
 package integer_representation
 
 import (
+	"errors"
 	"github.com/Jxck/swrap"
 	"log"
 )
 
+// ErrTruncated is returned when the buffer ends inside an integer
+var ErrTruncated = errors.New("hpack: truncated integer")
+
+// ErrOverflow is returned for an integer over 32 bit
+var ErrOverflow = errors.New("hpack: integer overflow")
+
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
@@ -66,33 +73,43 @@ func Encode(I uint32, N uint8) swrap.SWrap {
 //     While b > 128
 //         I += (b - 128) * 128^(i-1)
 //         i++
-func Decode(buf swrap.SWrap, N uint8) uint32 {
+//
+// It returns ErrOverflow when I does not fit in 32 bit.
+func Decode(buf swrap.SWrap, N uint8) (uint32, error) {
 	boundary := uint32(1<<N - 1) // 2^N-1
 	I := uint32(buf.Shift())     // Read N bit from first 1 byte as I
 	if I < boundary {            // less than 2^N-1
-		return I // as is
+		return I, nil // as is
 	}
+	var value uint64 = uint64(I)
 	for i := 0; ; i++ { // continue while follow bites are bigger than 128
 		b := buf.Shift()
 		shift := uint8(7 * i)
-		if b >= 128 { // if first bit is 1
-			// to 0 at first bit (- 128) and shift 7*i bit
-			// and add
-			I += uint32(b-128) << shift
-		} else { // if first bit is 0
-			// shit 7*i shift
-			// and add
-			I += uint32(b) << shift
+		// 5 bytes carry 35 bit, enough for 32 bit
+		if i > 4 {
+			return 0, ErrOverflow
+		}
+		// to 0 at first bit (- 128) and shift 7*i bit
+		// and add
+		value += uint64(b&127) << shift
+		if value > 1<<32-1 {
+			return 0, ErrOverflow
+		}
+		if b < 128 { // if first bit is 0
 			break
 		}
 	}
-	return I
+	return uint32(value), nil
 }
 
 // read prefixed N bytes from buffer
 // if N bit of first byte is 2^N-1 (ex 1111 in N=4)
-// read follow byte until it's smaller than 128
-func ReadPrefixedInteger(buf *swrap.SWrap, N uint8) swrap.SWrap {
+// read follow byte until it's smaller than 128.
+// It returns ErrTruncated when the buffer ends before that.
+func ReadPrefixedInteger(buf *swrap.SWrap, N uint8) (swrap.SWrap, error) {
+	if buf.Len() == 0 {
+		return nil, ErrTruncated
+	}
 	boundary := byte(1<<N - 1) // 2^N-1
 	first := buf.Shift()
 
@@ -102,11 +119,14 @@ func ReadPrefixedInteger(buf *swrap.SWrap, N uint8) swrap.SWrap {
 	// if first byte is smaller than boundary
 	// it's end of the prefixed bytes
 	if first < boundary {
-		return prefix
+		return prefix, nil
 	}
 
 	// read bytes while bytes smaller than 128
 	for {
+		if buf.Len() == 0 {
+			return nil, ErrTruncated
+		}
 		tmp := buf.Shift()
 		prefix.Add(tmp)
 		if tmp < 128 {
@@ -114,5 +134,5 @@ func ReadPrefixedInteger(buf *swrap.SWrap, N uint8) swrap.SWrap {
 		}
 	}
 
-	return prefix
+	return prefix, nil
 }
@@ -33,7 +33,7 @@ func main() {
 	defer func() {
 		err := recover()
 		if err != nil {
-			fmt.Println(`
+			fmt.Print(`
 # usage
 $ go run main/client.go http://localhost:3000 -l 4 -d "data to send" -n
 `)
@@ -1,34 +1,181 @@
 package minimalist_http2
 
 import (
-	"bytes"
 	"fmt"
+	"github.com/Jxck/color"
+	"github.com/Jxck/logger"
+	"minimalist-http2/frame"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// ResponseWriter sends the response on the stream while the handler
+// writes it. HEADERS are sent at the first Write or WriteHeader,
+// and each Write is sent in DATA frames as the peer window allows.
+// Trailers declared in the Trailer header, or set with http.TrailerPrefix,
+// are sent in the last HEADERS frame after the handler returns.
 type ResponseWriter struct {
-	status int
-	header http.Header
-	body   *bytes.Buffer
+	stream      *Stream
+	status      int
+	header      http.Header
+	wroteHeader bool
+	// fields declared in the Trailer header when HEADERS are sent
+	trailers http.Header
 }
 
-func NewResponseWriter() *ResponseWriter {
+func NewResponseWriter(stream *Stream) *ResponseWriter {
 	return &ResponseWriter{
+		stream: stream,
 		status: 0,
 		header: make(http.Header),
-		body:   bytes.NewBuffer([]byte{}),
 	}
 }
 
+// Write sends b in DATA frames, blocking until the peer window
+// allows them. It fails when the stream is closed or reset.
 func (r *ResponseWriter) Write(b []byte) (int, error) {
-	if r.status == 0 {
+	if !r.wroteHeader {
 		r.WriteHeader(http.StatusOK)
 	}
-	return r.body.Write(b)
+	if !bodyAllowed(r.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err := r.stream.WriteData(b, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
-func (r ResponseWriter) WriteHeader(status int) {
+
+// WriteHeader sends the response header in a HEADERS frame,
+// only the first call with a final status has effect. 1xx status
+// is sent as an informational response before the final one.
+// It panics for a status which is not 3 digits, the same as net/http.
+func (r *ResponseWriter) WriteHeader(status int) {
+	if status < 100 || status > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", status))
+	}
+	if r.wroteHeader {
+		logger.Error("stream(%d) superfluous WriteHeader(%d)", r.stream.ID, status)
+		return
+	}
+	if status >= 100 && status <= 199 {
+		// section 8.6 101 Switching Protocols is not used in HTTP/2
+		if status == http.StatusSwitchingProtocols {
+			logger.Error("stream(%d) WriteHeader(101) is not allowed in HTTP/2", r.stream.ID)
+			return
+		}
+		r.writeInformational(status)
+		return
+	}
+	r.wroteHeader = true
 	r.status = status
+	r.writeHeaders(false)
+}
+
+// Flush implements http.Flusher. Written data is already sent,
+// so it only sends the response header when it's not written yet.
+func (r *ResponseWriter) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+}
+
+// finish ends the stream after the handler returned, in the HEADERS frame
+// of trailers or of the response when nothing was written,
+// or else in an empty DATA frame.
+func (r *ResponseWriter) finish() {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.status = http.StatusOK
+		r.trailers = declaredTrailer(r.header)
+		if len(r.trailer()) == 0 {
+			r.writeHeaders(true)
+			return
+		}
+		r.writeHeaders(false)
+	}
+	if trailer := r.trailer(); len(trailer) > 0 {
+		r.stream.WriteHeaders(trailer, true)
+		return
+	}
+	if err := r.stream.WriteData(nil, true); err != nil {
+		logger.Debug("stream(%d) not ended: %v", r.stream.ID, err)
+	}
+}
+
+// writeHeaders sends the response header with :status, declared
+// fields and fields with http.TrailerPrefix are left for trailer
+func (r *ResponseWriter) writeHeaders(endStream bool) {
+	r.trailers = declaredTrailer(r.header)
+
+	responseHeader := make(http.Header, len(r.header)+1)
+	for name, value := range r.header {
+		if _, declared := r.trailers[name]; declared {
+			continue
+		}
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		responseHeader[name] = value
+	}
+	responseHeader.Set(":status", strconv.Itoa(r.status))
+
+	logger.Info("\n%s", color.Aqua(r.String()))
+
+	r.stream.WriteHeaders(responseHeader, endStream)
+}
+
+// writeInformational sends the header written so far with a 1xx status,
+// in HEADERS without END_STREAM followed by the final response, section 8.1
+func (r *ResponseWriter) writeInformational(status int) {
+	header := make(http.Header, len(r.header)+1)
+	for name, value := range r.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		header[name] = value
+	}
+	header.Set(":status", strconv.Itoa(status))
+
+	logger.Info("\n%s", color.Aqua(fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status))))
+
+	r.stream.WriteHeaders(header, false)
+}
+
+// trailer collects values of the declared trailers
+// and of fields with http.TrailerPrefix
+func (r *ResponseWriter) trailer() http.Header {
+	trailer := make(http.Header)
+	for name := range r.trailers {
+		if values, ok := r.header[name]; ok {
+			trailer[name] = values
+		}
+	}
+	for name, values := range r.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))] = values
+		}
+	}
+	return trailer
+}
+
+// bodyAllowed reports whether a response with status can have a body,
+// RFC 7230 section 3.3
+func bodyAllowed(status int) bool {
+	if status >= 100 && status <= 199 {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// AdvertiseAltSvc sends fieldValue in an ALTSVC frame on the stream
+// of the response, for the origin of the request.
+func (r *ResponseWriter) AdvertiseAltSvc(fieldValue string) {
+	r.stream.Write(frame.NewAltSvcFrame(r.stream.ID, "", fieldValue))
 }
 
 func (r *ResponseWriter) Header() http.Header {
@@ -0,0 +1,57 @@
+package minimalist_http2
+
+import (
+	"minimalist-http2/frame"
+	"net/http"
+	"testing"
+)
+
+func TestWriteHeaderInformational(t *testing.T) {
+	_, peer := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	peer.writeHeaders(1, "GET", "/", frame.HEADERS_END_STREAM)
+
+	frames := peer.response(1)
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want HEADERS, HEADERS, DATA and DATA with END_STREAM", len(frames))
+	}
+	informational, ok := frames[0].(*frame.HeadersFrame)
+	if !ok || informational.Headers.Get(":status") != "103" || informational.Flags.Has(frame.HEADERS_END_STREAM) {
+		t.Fatalf("first frame = %v, want HEADERS 103 without END_STREAM", frames[0])
+	}
+	if link := informational.Headers.Get("Link"); link != "</style.css>; rel=preload" {
+		t.Errorf("Link of 103 = %q", link)
+	}
+	final, ok := frames[1].(*frame.HeadersFrame)
+	if !ok || final.Headers.Get(":status") != "200" || final.Headers.Get("Content-Type") != "text/plain" {
+		t.Fatalf("second frame = %v, want HEADERS 200", frames[1])
+	}
+	if data, ok := frames[2].(*frame.DataFrame); !ok || string(data.Data) != "ok" {
+		t.Errorf("third frame = %v, want DATA ok", frames[2])
+	}
+}
+
+func TestWriteHeaderSwitchingProtocols(t *testing.T) {
+	_, peer := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		w.Write([]byte("ok"))
+	}))
+	peer.writeHeaders(1, "GET", "/", frame.HEADERS_END_STREAM)
+
+	frames := peer.response(1)
+	headers, ok := frames[0].(*frame.HeadersFrame)
+	if !ok || headers.Headers.Get(":status") != "200" {
+		t.Fatalf("first frame = %v, want HEADERS 200", frames[0])
+	}
+	if len(frames) < 2 {
+		t.Fatal("no DATA after HEADERS")
+	}
+	if data, ok := frames[1].(*frame.DataFrame); !ok || string(data.Data) != "ok" {
+		t.Errorf("second frame = %v, want DATA ok", frames[1])
+	}
+}
@@ -0,0 +1,355 @@
+package minimalist_http2
+
+import (
+	"minimalist-http2/frame"
+	"sync"
+)
+
+// section 5.3.5 weight of streams without priority
+const defaultWeight = 16
+
+// nodes kept for streams which are not open, idle ones the peer sent
+// priority of and closed ones others depend on. The oldest is removed
+// when there are more.
+const maxIdleNodes = 10
+
+// writeRequest is frames queued by WriteFrames, written one after another.
+// done is closed when WriteLoop takes them or they are dropped.
+type writeRequest struct {
+	frames []frame.Frame
+	done   chan struct{}
+}
+
+func (req *writeRequest) streamID() uint32 {
+	return req.frames[0].Header().StreamID
+}
+
+// priorityNode is a stream in the dependency tree, section 5.3
+type priorityNode struct {
+	id       uint32
+	weight   int // 1 to 256
+	parent   *priorityNode
+	children []*priorityNode
+	// DATA of the stream waiting for WriteLoop
+	queue []*writeRequest
+	// number of requests queued to the node and its dependents
+	active int
+	// grows by the bytes written through the node divided by its weight,
+	// the sibling with the smallest one is written next
+	vtime uint64
+	// vtime of the child written last, which children start from
+	// when they get DATA to write
+	childVtime uint64
+}
+
+// next returns the node to write DATA of, which is node itself while it has
+// DATA and the dependent by weight otherwise. It's nil when nothing is queued.
+func (node *priorityNode) next() *priorityNode {
+	if len(node.queue) > 0 {
+		return node
+	}
+	var next *priorityNode
+	for _, child := range node.children {
+		if child.active > 0 && (next == nil || child.vtime < next.vtime) {
+			next = child
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	return next.next()
+}
+
+// dependsOn is true when node is a descendant of ancestor
+func (node *priorityNode) dependsOn(ancestor *priorityNode) bool {
+	for parent := node.parent; parent != nil; parent = parent.parent {
+		if parent == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *priorityNode) add(child *priorityNode) {
+	child.parent = node
+	child.vtime = node.childVtime
+	node.children = append(node.children, child)
+	node.count(child.active)
+}
+
+func (node *priorityNode) remove(child *priorityNode) {
+	for i, c := range node.children {
+		if c == child {
+			node.children = append(node.children[:i], node.children[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+	node.count(-child.active)
+}
+
+// count adds n to the active requests of the node and its ancestors
+func (node *priorityNode) count(n int) {
+	for ; node != nil; node = node.parent {
+		node.active += n
+	}
+}
+
+// writeScheduler orders frames for WriteLoop. Control frames are written
+// first, then other frames in the order they are queued, which keeps header
+// blocks in the order of the encoder, then DATA of the streams interleaved
+// by the dependency tree the peer sent in HEADERS and PRIORITY frames.
+type writeScheduler struct {
+	mu      sync.Mutex
+	control []*writeRequest
+	other   []*writeRequest
+	root    *priorityNode
+	nodes   map[uint32]*priorityNode
+	// nodes of streams which are not open, the oldest first
+	idle []*priorityNode
+	// receives a value when frames are queued
+	ready chan struct{}
+}
+
+func newWriteScheduler() *writeScheduler {
+	return &writeScheduler{
+		root:  &priorityNode{weight: defaultWeight},
+		nodes: make(map[uint32]*priorityNode),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// isControl is true for frames written before any other,
+// SETTINGS, PING, GOAWAY, RST_STREAM and WINDOW_UPDATE
+func isControl(f frame.Frame) bool {
+	switch f.Header().Type {
+	case frame.SettingsFrameType,
+		frame.PingFrameType,
+		frame.GoAwayFrameType,
+		frame.RstStreamFrameType,
+		frame.WindowUpdateFrameType:
+		return true
+	}
+	return false
+}
+
+// push queues frames, which are written in a row,
+// and returns the channel closed when they are taken
+func (ws *writeScheduler) push(frames []frame.Frame) chan struct{} {
+	req := &writeRequest{
+		frames: frames,
+		done:   make(chan struct{}),
+	}
+
+	ws.mu.Lock()
+	switch {
+	case frames[0].Header().Type == frame.DataFrameType:
+		ws.pushData(req)
+	case frames[0].Header().Type == frame.RstStreamFrameType:
+		// DATA after RST_STREAM is never needed, but a header block
+		// queued before stays in the order of the encoder
+		ws.drop(req.streamID())
+		if ws.pending(req.streamID()) {
+			ws.other = append(ws.other, req)
+		} else {
+			ws.control = append(ws.control, req)
+		}
+	case isControl(frames[0]):
+		ws.control = append(ws.control, req)
+	default:
+		ws.other = append(ws.other, req)
+	}
+	ws.mu.Unlock()
+
+	select {
+	case ws.ready <- struct{}{}:
+	default:
+	}
+	return req.done
+}
+
+// pushData queues DATA to the node of the stream,
+// which starts from the vtime of its siblings when it becomes active
+func (ws *writeScheduler) pushData(req *writeRequest) {
+	node := ws.node(req.streamID())
+	for n := node; n != ws.root && n.active == 0; n = n.parent {
+		if n.vtime < n.parent.childVtime {
+			n.vtime = n.parent.childVtime
+		}
+	}
+	node.queue = append(node.queue, req)
+	node.count(1)
+}
+
+// pending is true when frames other than DATA of streamID are queued
+func (ws *writeScheduler) pending(streamID uint32) bool {
+	for _, req := range ws.other {
+		if req.streamID() == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+// drop releases the DATA of streamID waiting in the queue
+func (ws *writeScheduler) drop(streamID uint32) {
+	node, ok := ws.nodes[streamID]
+	if !ok {
+		return
+	}
+	for _, req := range node.queue {
+		close(req.done)
+	}
+	node.count(-len(node.queue))
+	node.queue = nil
+}
+
+// pop takes the frames to write next, nil when nothing is queued
+func (ws *writeScheduler) pop() []frame.Frame {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	var req *writeRequest
+	switch {
+	case len(ws.control) > 0:
+		req, ws.control = ws.control[0], ws.control[1:]
+	case len(ws.other) > 0:
+		req, ws.other = ws.other[0], ws.other[1:]
+	default:
+		node := ws.root.next()
+		if node == nil {
+			return nil
+		}
+		req, node.queue = node.queue[0], node.queue[1:]
+		node.count(-1)
+
+		// the stream and its ancestors are charged for the bytes
+		var length uint64
+		for _, f := range req.frames {
+			length += uint64(f.Header().Length)
+		}
+		for n := node; n != ws.root; n = n.parent {
+			n.parent.childVtime = n.vtime
+			n.vtime += length * 256 / uint64(n.weight)
+		}
+	}
+	close(req.done)
+	return req.frames
+}
+
+// node returns the node of streamID, which is added
+// with the default priority when it's not in the tree
+func (ws *writeScheduler) node(streamID uint32) *priorityNode {
+	if streamID == 0 {
+		return ws.root
+	}
+	node, ok := ws.nodes[streamID]
+	if !ok {
+		node = &priorityNode{id: streamID, weight: defaultWeight}
+		ws.root.add(node)
+		ws.nodes[streamID] = node
+		ws.idle = append(ws.idle, node)
+	}
+	return node
+}
+
+// open keeps the node of streamID in the tree until the stream is removed
+func (ws *writeScheduler) open(streamID uint32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.forget(ws.node(streamID))
+}
+
+// forget takes node out of the idle nodes
+func (ws *writeScheduler) forget(node *priorityNode) {
+	for i, n := range ws.idle {
+		if n == node {
+			ws.idle = append(ws.idle[:i], ws.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// evict removes the oldest idle nodes over maxIdleNodes
+func (ws *writeScheduler) evict() {
+	for len(ws.idle) > maxIdleNodes {
+		ws.removeNode(ws.idle[0])
+	}
+}
+
+// prioritize makes streamID depend on the stream dependency of priority
+// with its weight, section 5.3.1 to 5.3.3
+func (ws *writeScheduler) prioritize(streamID uint32, priority *frame.DependencyTree) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	node := ws.node(streamID)
+	parent := ws.node(priority.StreamDependency)
+
+	// section 5.3.3 the dependency moves to the former parent first
+	// when the stream depends on its own dependent
+	if parent.dependsOn(node) {
+		parent.parent.remove(parent)
+		node.parent.add(parent)
+	}
+
+	node.parent.remove(node)
+	node.weight = int(priority.Weight) + 1
+
+	// section 5.3.1 an exclusive dependency takes
+	// the other dependents of the parent
+	if priority.Exclusive {
+		for _, child := range append([]*priorityNode(nil), parent.children...) {
+			parent.remove(child)
+			node.add(child)
+		}
+	}
+	parent.add(node)
+	ws.evict()
+}
+
+// remove drops the DATA of streamID and takes it out of the tree,
+// or keeps it with the idle nodes while it has dependents
+func (ws *writeScheduler) remove(streamID uint32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	node, ok := ws.nodes[streamID]
+	if !ok {
+		return
+	}
+	// a closed stream stays while others depend on it
+	// so that priority they are sent later still applies
+	if len(node.children) > 0 {
+		ws.drop(streamID)
+		ws.forget(node)
+		ws.idle = append(ws.idle, node)
+		ws.evict()
+		return
+	}
+	ws.removeNode(node)
+}
+
+// removeNode takes node out of the tree and drops its DATA. Its dependents
+// depend on its parent and share its weight, section 5.3.4
+func (ws *writeScheduler) removeNode(node *priorityNode) {
+	ws.drop(node.id)
+	delete(ws.nodes, node.id)
+	ws.forget(node)
+
+	parent := node.parent
+	parent.remove(node)
+
+	total := 0
+	for _, child := range node.children {
+		total += child.weight
+	}
+	for _, child := range node.children {
+		child.weight = node.weight * child.weight / total
+		if child.weight < 1 {
+			child.weight = 1
+		}
+		parent.add(child)
+	}
+}
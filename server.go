@@ -7,10 +7,11 @@ import (
 	"github.com/Jxck/logger"
 	"log"
 	"minimalist-http2/frame"
-	"minimalist-http2/hpack"
+	"minimalist-http2/h2"
 	"net"
 	"net/http"
 	neturl "net/url"
+	"sort"
 	"strconv"
 )
 
@@ -28,12 +29,92 @@ var TSLNextProtoHandler = func(server *http.Server, conn *tls.Conn, handler http
 	return
 }
 
-func HandleTLSConnection(conn net.Conn, handler http.Handler) {
+// ServerConfig is applied to every connection served by HandleTLSConnection
+type ServerConfig struct {
+	// Alt-Svc field value by origin,
+	// advertised in ALTSVC frames on stream 0 after SETTINGS (RFC 7838)
+	AltSvc map[string]string
+	// origins the server is authoritative for,
+	// sent in an ORIGIN frame right after SETTINGS (RFC 8336)
+	Origins []string
+	// limit of request header lists, advertised in
+	// SETTINGS_MAX_HEADER_LIST_SIZE, DefaultMaxHeaderListSize if zero
+	MaxHeaderListSize int32
+	// receive windows are auto-tuned up to MaxReceiveWindow,
+	// they are fixed if zero
+	MaxReceiveWindow int32
+}
+
+type ServerOption func(config *ServerConfig)
+
+// WithAltSvc advertises alternative services for origin on every connection
+func WithAltSvc(origin, fieldValue string) ServerOption {
+	return func(config *ServerConfig) {
+		if config.AltSvc == nil {
+			config.AltSvc = make(map[string]string)
+		}
+		config.AltSvc[origin] = fieldValue
+	}
+}
+
+// WithOrigins sends origins in an ORIGIN frame on every connection,
+// so clients can coalesce requests for them onto the connection
+func WithOrigins(origins ...string) ServerOption {
+	return func(config *ServerConfig) {
+		config.Origins = append(config.Origins, origins...)
+	}
+}
+
+// AltSvcAdvertiser is implemented by the http.ResponseWriter given to handlers,
+// so a single response can advertise alternative services for its origin.
+type AltSvcAdvertiser interface {
+	AdvertiseAltSvc(fieldValue string)
+}
+
+// WithMaxHeaderListSize answers requests with header lists
+// larger than size with 431 Request Header Fields Too Large
+func WithMaxHeaderListSize(size int32) ServerOption {
+	return func(config *ServerConfig) {
+		config.MaxHeaderListSize = size
+	}
+}
+
+// WithWindowAutoTuning grows receive windows up to max
+// as the bandwidth-delay product of the connection grows
+func WithWindowAutoTuning(max int32) ServerOption {
+	return func(config *ServerConfig) {
+		config.MaxReceiveWindow = max
+	}
+}
+
+// NewTLSNextProto returns a http.Server.TLSNextProto
+// which serves connections with options.
+func NewTLSNextProto(options ...ServerOption) map[string]func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+	return map[string]func(server *http.Server, conn *tls.Conn, handler http.Handler){
+		VERSION: func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+			logger.Notice(color.Yellow("New Connection from %s"), conn.RemoteAddr())
+			HandleTLSConnection(conn, handler, options...)
+		},
+	}
+}
+
+func HandleTLSConnection(conn net.Conn, handler http.Handler, options ...ServerOption) {
 	logger.Info("Handle TLS Connection")
 
-	Conn := NewConnection(conn)
+	config := new(ServerConfig)
+	for _, option := range options {
+		option(config)
+	}
+
+	Conn := NewServerConnection(conn)
 
 	Conn.CallBack = HandlerCallBack(handler)
+	if config.MaxHeaderListSize > 0 {
+		Conn.SetMaxHeaderListSize(config.MaxHeaderListSize)
+	}
+	if config.MaxReceiveWindow > 0 {
+		Conn.EnableWindowAutoTuning(config.MaxReceiveWindow)
+	}
 
 	err := Conn.ReadMagic()
 	if err != nil {
@@ -43,8 +124,16 @@ func HandleTLSConnection(conn net.Conn, handler http.Handler) {
 
 	go Conn.WriteLoop()
 
-	settingsFrame := frame.NewSettingsFrame(frame.UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
+	settingsFrame := frame.NewSettingsFrame(frame.UNSET, 0, Conn.Settings)
+	Conn.WriteFrame(settingsFrame)
+
+	if len(config.Origins) > 0 {
+		Conn.WriteFrame(frame.NewOriginFrame(config.Origins))
+	}
+
+	for _, origin := range sortedKeys(config.AltSvc) {
+		Conn.WriteFrame(frame.NewAltSvcFrame(0, origin, config.AltSvc[origin]))
+	}
 
 	Conn.ReadLoop()
 
@@ -55,10 +144,12 @@ func HandleTLSConnection(conn net.Conn, handler http.Handler) {
 	return
 }
 
+// HandlerCallBack serves requests with handler, which is called at the
+// request HEADERS and reads the body as it arrives on the stream.
 func HandlerCallBack(handler http.Handler) CallBack {
 	return func(stream *Stream) {
 		header := stream.Bucket.Headers
-		body := stream.Bucket.Body
+		body := stream.Body
 
 		authority := header.Get(":authority")
 		method := header.Get(":method")
@@ -76,6 +167,15 @@ func HandlerCallBack(handler http.Handler) CallBack {
 			logger.Fatal("%v", err)
 		}
 
+		// -1 for unknown length, the body is still streaming
+		contentLength, err := strconv.ParseInt(header.Get("content-length"), 10, 64)
+		if err != nil {
+			contentLength = -1
+		}
+		if state := stream.state(); state == HALF_CLOSED_REMOTE || state == CLOSED {
+			contentLength = 0
+		}
+
 		req := &http.Request{
 			Method:           method,
 			URL:              url,
@@ -84,72 +184,36 @@ func HandlerCallBack(handler http.Handler) CallBack {
 			ProtoMinor:       1,
 			Header:           header,
 			Body:             body,
-			ContentLength:    int64(body.Buffer.Len()),
+			ContentLength:    contentLength,
 			TransferEncoding: []string{},
 			Close:            false,
 			Host:             authority,
+			Trailer:          declaredTrailer(header),
 		}
+		header.Del("Trailer")
 
-		logger.Info("\n%s", color.Lime(util.RequestString(req)))
-
-		// Handle HTTP using handler
-		res := NewResponseWriter()
-		handler.ServeHTTP(res, req)
-		responseHeader := res.Header()
-		responseHeader.Add(":status", strconv.Itoa(res.status))
-
-		logger.Info("\n%s", color.Aqua(res.String()))
-
-		// send response header ad HEADERS frame
-		headerList := hpack.ToHeaderList(responseHeader)
-		headerBlockFragment := stream.HPackContext.Encode(*headerList)
-		logger.Debug("%v", headerList)
-
-		headersFrame := frame.NewHeadersFrame(frame.HEADERS_END_HEADERS, stream.ID, nil, headerBlockFragment, nil)
-		headersFrame.Headers = responseHeader
-
-		stream.Write(headersFrame)
+		// trailers are filled in once the body is read to io.EOF
+		body.trailer = &req.Trailer
 
-		// Send response body as DATA Frame
-		// each DataFrame has data in window size
-		data := res.body.Bytes()
-		maxFrameSize := stream.PeerSettings[frame.SETTINGS_MAX_FRAME_SIZE]
-		rest := int32(len(data))
-		frameSize := rest
-
-		for {
-			logger.Debug("rest data size(%v), current peer(%v) window(%v)", rest, stream.ID, stream.Window)
-
-			if rest == 0 {
-				break
-			}
-
-			frameSize = stream.Window.Consumable(rest)
-
-			if frameSize <= 0 {
-				continue
-			}
-
-			if frameSize > maxFrameSize {
-				frameSize = maxFrameSize
-			}
-
-			logger.Debug("send %v/%v data", frameSize, rest)
-
-			dataToSend := make([]byte, frameSize)
-			copy(dataToSend, data[:frameSize])
-			dataFrame := frame.NewDataFrame(frame.UNSET, stream.ID, dataToSend, nil)
-			stream.Write(dataFrame)
-
-			rest -= frameSize
-			copy(data, data[frameSize:])
-			data = data[:rest]
+		logger.Info("\n%s", color.Lime(util.RequestString(req)))
 
-			stream.Window.ConsumePeer(frameSize)
-		}
+		// Handle HTTP using handler without blocking the frames
+		// of the request body, the response is sent while it's written
+		go func() {
+			res := NewResponseWriter(stream)
+			handler.ServeHTTP(res, req)
+			res.finish()
+			// the rest of the request is not read any more, section 8.1
+			body.cancel(h2.NO_ERROR)
+		}()
+	}
+}
 
-		// End Stream in empty DATA Frame
-		endDataFrame := frame.NewDataFrame(frame.DATA_END_STREAM, stream.ID, nil, nil)
-		stream.Write(endDataFrame)
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
 }
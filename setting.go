@@ -9,13 +9,27 @@ const (
 	CONNECTION_PREFACE        = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 )
 
+// DefaultMaxHeaderListSize is advertised in SETTINGS_MAX_HEADER_LIST_SIZE
+// and enforced while decoding header blocks, unless it is configured
+const DefaultMaxHeaderListSize int32 = 1 << 20
+
 var DefaultSettings = map[frame.SettingsID]int32{
 	frame.SETTINGS_HEADER_TABLE_SIZE: frame.DEFAULT_HEADER_TABLE_SIZE,
 	// SETTINGS_ENABLE_PUSH:            DEFAULT_ENABLE_PUSH, // server dosen't send this
 	frame.SETTINGS_MAX_CONCURRENT_STREAMS: frame.DEFAULT_MAX_CONCURRENT_STREAMS,
 	frame.SETTINGS_INITIAL_WINDOW_SIZE:    frame.DEFAULT_INITIAL_WINDOW_SIZE,
 	frame.SETTINGS_MAX_FRAME_SIZE:         frame.DEFAULT_MAX_FRAME_SIZE,
-	frame.SETTINGS_MAX_HEADER_LIST_SIZE:   frame.DEFAULT_MAX_HEADER_LIST_SIZE,
+	frame.SETTINGS_MAX_HEADER_LIST_SIZE:   DefaultMaxHeaderListSize,
 }
 
 var NilSettings = make(map[frame.SettingsID]int32, 0)
+
+// CopySettings returns a copy of settings,
+// so each connection can update its own
+func CopySettings(settings map[frame.SettingsID]int32) map[frame.SettingsID]int32 {
+	copied := make(map[frame.SettingsID]int32, len(settings))
+	for k, v := range settings {
+		copied[k] = v
+	}
+	return copied
+}
@@ -1,11 +1,17 @@
 package minimalist_http2
 
 import (
+	"fmt"
 	"github.com/Jxck/logger"
+	"io"
 	"log"
 	"minimalist-http2/frame"
+	"minimalist-http2/h2"
 	"minimalist-http2/hpack"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 func init() {
@@ -17,28 +23,38 @@ type Stream struct {
 	State        StreamState
 	Window       *Window
 	ReadChan     chan frame.Frame
-	WriteChan    chan frame.Frame
+	Conn         *Connection
 	Settings     map[frame.SettingsID]int32
 	PeerSettings map[frame.SettingsID]int32
-	HPackContext *hpack.Context
 	CallBack     CallBack
 	Bucket       *Bucket
-	Closed       bool
+	// Body is fed by DATA frames while the application reads it,
+	// CallBack is then called as soon as HEADERS arrive.
+	// DATA frames are collected in Bucket.Body when it's nil.
+	Body            *Pipe
+	headersReceived bool
+	// origin of the request on streams opened by the client, as URL.Origin()
+	Origin string
+	// guards State changed by both sending and receiving frames
+	stateMu sync.Mutex
+	// closed by Close, err is set when the stream ends without response
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
-func NewStream(id uint32, writeChan chan frame.Frame, settings, peerSettings map[frame.SettingsID]int32, hpackContext *hpack.Context, callback CallBack) *Stream {
+func NewStream(conn *Connection, id uint32, callback CallBack) *Stream {
 	stream := &Stream{
 		ID:           id,
 		State:        IDLE,
-		Window:       NewWindow(settings[frame.SETTINGS_INITIAL_WINDOW_SIZE], peerSettings[frame.SETTINGS_INITIAL_WINDOW_SIZE]),
+		Window:       NewWindow(conn.Setting(frame.SETTINGS_INITIAL_WINDOW_SIZE), conn.PeerSetting(frame.SETTINGS_INITIAL_WINDOW_SIZE)),
 		ReadChan:     make(chan frame.Frame),
-		WriteChan:    writeChan,
-		Settings:     settings,
-		PeerSettings: peerSettings,
-		HPackContext: hpackContext,
+		Conn:         conn,
+		Settings:     conn.Settings,
+		PeerSettings: conn.PeerSettings,
 		CallBack:     callback,
 		Bucket:       NewBucket(),
-		Closed:       false,
+		done:         make(chan struct{}),
 	}
 	go stream.ReadLoop()
 	return stream
@@ -47,55 +63,378 @@ func NewStream(id uint32, writeChan chan frame.Frame, settings, peerSettings map
 type Bucket struct {
 	Headers http.Header
 	Body    *Body
+	// fields of HEADERS frames after the first one
+	Trailer http.Header
 }
 
 func NewBucket() *Bucket {
 	return &Bucket{
 		Headers: make(http.Header),
 		Body:    new(Body),
+		Trailer: make(http.Header),
 	}
 }
 
+// CallBack is called once the peer ended the stream,
+// or at the first HEADERS when the stream has Body.
 type CallBack func(stream *Stream)
 
+// Read collects headers of the stream into Bucket, and body
+// into Body or Bucket, then calls CallBack.
 func (stream *Stream) Read(f frame.Frame) {
 	logger.Debug("stream (%d) recv (%v)", stream.ID, f.Header().Type)
 
+	switch fr := f.(type) {
+	case *frame.HeadersFrame:
+		if err := stream.checkHeaders(fr); err != nil {
+			logger.Error("stream(%d) malformed: %v", stream.ID, err)
+			stream.Conn.WriteFrame(frame.NewRstStreamFrame(stream.ID, h2.PROTOCOL_ERROR))
+			stream.Reset(h2.StreamError{StreamID: stream.ID, Code: h2.PROTOCOL_ERROR})
+			return
+		}
+		// section 8.1 informational responses before the final one are skipped
+		if !stream.headersReceived && informational(fr.Headers) {
+			return
+		}
+
+		// HEADERS after the header block are trailers
+		headers := stream.Bucket.Headers
+		if stream.headersReceived {
+			headers = stream.Bucket.Trailer
+		}
+		for name, values := range fr.Headers {
+			for _, value := range values {
+				headers.Add(name, value)
+			}
+		}
+		if !stream.headersReceived {
+			stream.headersReceived = true
+			if stream.Body != nil {
+				stream.complete()
+			}
+		}
+		if fr.Flags.Has(frame.HEADERS_END_STREAM) {
+			stream.endStream()
+		}
+	case *frame.DataFrame:
+		// padding is consumed on arrival, data when it's read
+		stream.consume(int32(fr.Length)-int32(len(fr.Data)), true)
+		if stream.Body != nil {
+			stream.Body.write(fr.Data)
+		} else {
+			stream.Bucket.Body.Write(fr.Data)
+			stream.consume(int32(len(fr.Data)), true)
+		}
+		if fr.Flags.Has(frame.DATA_END_STREAM) {
+			stream.endStream()
+		}
+	case *frame.RstStreamFrame:
+		stream.Reset(h2.StreamError{StreamID: stream.ID, Code: fr.ErrCode})
+	}
+}
+
+// checkHeaders validates HEADERS in the order of the message, section 8.1.
+// Trailers end the stream and have no pseudo-header fields,
+// and informational responses never end it.
+func (stream *Stream) checkHeaders(fr *frame.HeadersFrame) error {
+	endStream := fr.Flags.Has(frame.HEADERS_END_STREAM)
+	if stream.headersReceived {
+		if !endStream {
+			return fmt.Errorf("HEADERS without END_STREAM after the header block")
+		}
+		for name := range fr.Headers {
+			if strings.HasPrefix(name, ":") {
+				return fmt.Errorf("pseudo-header field %s in trailers", name)
+			}
+		}
+		return nil
+	}
+	if informational(fr.Headers) {
+		// section 8.6 101 Switching Protocols is not used in HTTP/2
+		if fr.Headers.Get(":status") == strconv.Itoa(http.StatusSwitchingProtocols) {
+			return fmt.Errorf("101 response")
+		}
+		if endStream {
+			return fmt.Errorf("informational response with END_STREAM")
+		}
+	}
+	return nil
+}
+
+// informational reports whether header is of a 1xx response
+func informational(header http.Header) bool {
+	status, err := strconv.Atoi(header.Get(":status"))
+	return err == nil && status >= 100 && status <= 199
+}
+
+// the peer ended the stream, which is closed once this
+// endpoint has ended it too, the request body may still be sent
+func (stream *Stream) endStream() {
+	if stream.Body == nil {
+		stream.complete()
+		return
+	}
+	stream.Body.setTrailer(stream.Bucket.Trailer)
+	stream.Body.closeWithError(io.EOF)
+	if stream.state() == CLOSED {
+		stream.Close()
+	}
+}
+
+// consume opens the receive windows again by length consumed by the
+// application, and sends WINDOW_UPDATE for the stream when update is true.
+func (stream *Stream) consume(length int32, update bool) {
+	if length <= 0 {
+		return
+	}
+	stream.Conn.WindowConsume(length)
+
+	increment := stream.Window.Consume(length)
+	if increment > 0 && update {
+		stream.Conn.WriteFrame(frame.NewWindowUpdateFrame(stream.ID, uint32(increment)))
+	}
+}
+
+// run CallBack without blocking frames for this stream,
+// with Body it only hands the headers over before the body arrives
+func (stream *Stream) complete() {
+	if stream.CallBack == nil {
+		return
+	}
+	if stream.Body != nil {
+		stream.CallBack(stream)
+		return
+	}
+	go stream.CallBack(stream)
 }
 
 func (stream *Stream) ReadLoop() {
 	logger.Debug("start stream (%d) ReadLoop()", stream.ID)
-	for f := range stream.ReadChan {
-		stream.Read(f)
+	for {
+		select {
+		case f := <-stream.ReadChan:
+			stream.Read(f)
+		case <-stream.done:
+			logger.Debug("stop Stream (%d) ReadLoop()", stream.ID)
+			return
+		}
+	}
+}
+
+// isClosed reports whether the stream is closed or reset
+func (stream *Stream) isClosed() bool {
+	select {
+	case <-stream.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// receive passes f to ReadLoop, frames after Close are dropped
+func (stream *Stream) receive(f frame.Frame) {
+	select {
+	case stream.ReadChan <- f:
+	case <-stream.done:
+	}
+}
+
+func (stream *Stream) Write(f frame.Frame) {
+	logger.Trace("stream.Write (%v)", f)
+	if stream.isClosed() {
+		return
 	}
-	logger.Debug("stop Stream (%d) ReadLoop()", stream.ID)
+	stream.write(f)
 }
 
-func (stream *Stream) Write(frame frame.Frame) {
-	logger.Trace("stream.Write (%v)", frame)
-	if stream.Closed {
+// WriteHeaders encodes header and sends it in a HEADERS frame, with END_STREAM
+// when endStream is true. Header blocks are encoded in the order they are
+// sent, for the peer decodes them with the dynamic table built by the former.
+func (stream *Stream) WriteHeaders(header http.Header, endStream bool) {
+	stream.Conn.headerMu.Lock()
+	defer stream.Conn.headerMu.Unlock()
+	if stream.isClosed() {
 		return
 	}
-	stream.ChangeState(frame, SEND)
-	stream.WriteChan <- frame
+
+	var flags frame.Flag = frame.HEADERS_END_HEADERS
+	if endStream {
+		flags += frame.HEADERS_END_STREAM
+	}
+	headersFrame := frame.NewHeadersFrame(flags, stream.ID, nil, stream.EncodeHeader(header), nil)
+	headersFrame.Headers = header
+	stream.write(headersFrame)
+}
+
+// write sends f even when the stream is closed meanwhile,
+// HEADERS are split into CONTINUATION frames
+func (stream *Stream) write(f frame.Frame) {
+	stream.ChangeState(f, SEND)
+	if headersFrame, ok := f.(*frame.HeadersFrame); ok {
+		maxFrameSize := stream.Conn.PeerSetting(frame.SETTINGS_MAX_FRAME_SIZE)
+		stream.Conn.WriteFrames(splitHeaderBlock(headersFrame, maxFrameSize)...)
+	} else {
+		stream.Conn.WriteFrame(f)
+	}
+	if stream.state() == CLOSED {
+		stream.Close()
+	}
+}
+
+// splitHeaderBlock returns f followed by CONTINUATION frames,
+// when its header block does not fit in maxFrameSize
+func splitHeaderBlock(f *frame.HeadersFrame, maxFrameSize int32) []frame.Frame {
+	overhead := int32(f.Length) - int32(len(f.HeaderBlockFragment))
+	// a size leaving no room for the block would never end the loop,
+	// every endpoint accepts the default size
+	if maxFrameSize <= overhead {
+		maxFrameSize = frame.DEFAULT_MAX_FRAME_SIZE
+	}
+	headerBlock := f.HeaderBlockFragment
+	if int32(len(headerBlock)) <= maxFrameSize-overhead {
+		return []frame.Frame{f}
+	}
+
+	first := frame.NewHeadersFrame(f.Flags&^frame.HEADERS_END_HEADERS, f.StreamID,
+		f.DependencyTree, headerBlock[:maxFrameSize-overhead], f.Padding)
+	first.Headers = f.Headers
+	frames := []frame.Frame{first}
+	headerBlock = headerBlock[maxFrameSize-overhead:]
+	for len(headerBlock) > 0 {
+		length := int32(len(headerBlock))
+		var flags frame.Flag = frame.UNSET
+		if length <= maxFrameSize {
+			flags = frame.CONTINUAION_END_HEADERS
+		} else {
+			length = maxFrameSize
+		}
+		frames = append(frames, frame.NewContinuationFrame(flags, f.StreamID, headerBlock[:length]))
+		headerBlock = headerBlock[length:]
+	}
+	return frames
+}
+
+// WriteData sends data in DATA frames no larger than SETTINGS_MAX_FRAME_SIZE
+// of the peer, waiting for the stream and connection windows to allow them.
+// The last frame has END_STREAM when endStream is true.
+func (stream *Stream) WriteData(data []byte, endStream bool) error {
+	for {
+		length := int32(len(data))
+		maxFrameSize := stream.Conn.PeerSetting(frame.SETTINGS_MAX_FRAME_SIZE)
+		if maxFrameSize <= 0 {
+			return ErrInvalidFrameSize
+		}
+		if length > maxFrameSize {
+			length = maxFrameSize
+		}
+		if length > 0 {
+			var err error
+			length, err = stream.takeWindow(length)
+			if err != nil {
+				return err
+			}
+		}
+
+		var flags frame.Flag = frame.UNSET
+		if endStream && int(length) == len(data) {
+			flags = frame.DATA_END_STREAM
+		}
+		logger.Debug("send %v/%v data", length, len(data))
+
+		// data can be reused by the caller after WriteData
+		dataToSend := make([]byte, length)
+		copy(dataToSend, data[:length])
+		dataFrame := frame.NewDataFrame(flags, stream.ID, dataToSend, nil)
+
+		// frames before the last are queued without waiting, so they are
+		// interleaved with other streams by priority, and the last one
+		// returns once all of them are taken
+		data = data[length:]
+		if len(data) == 0 {
+			stream.Write(dataFrame)
+			return nil
+		}
+		stream.queue(dataFrame)
+	}
+}
+
+// queue sends DATA f without waiting for WriteLoop,
+// which takes the frames of a stream in order
+func (stream *Stream) queue(f *frame.DataFrame) {
+	if stream.isClosed() {
+		return
+	}
+	stream.ChangeState(f, SEND)
+	stream.Conn.scheduler.push([]frame.Frame{f})
+}
+
+// takeWindow consumes up to length from both the stream window and
+// the connection window, and waits while either of them is empty.
+// The connection window is shared by streams in turn.
+func (stream *Stream) takeWindow(length int32) (int32, error) {
+	for {
+		taken, wait := stream.Window.TakePeer(length)
+		if taken > 0 {
+			connTaken, ok := stream.Conn.Window.AcquirePeer(taken, stream.done)
+			if connTaken < taken {
+				stream.Window.ReturnPeer(taken - connTaken)
+			}
+			if !ok {
+				return 0, stream.Err()
+			}
+			return connTaken, nil
+		}
+
+		logger.Debug("stream(%d) waits for window update", stream.ID)
+		select {
+		case <-wait:
+		case <-stream.done:
+			return 0, stream.Err()
+		}
+	}
 }
 
 func (stream *Stream) Close() {
-	logger.Debug("stream(%d) Close()", stream.ID)
-	stream.Closed = true
-	logger.Info("close stream(%v).ReadChan", stream.ID)
-	close(stream.ReadChan)
+	stream.closeOnce.Do(func() {
+		logger.Debug("stream(%d) Close()", stream.ID)
+		close(stream.done)
+		stream.Conn.removeStream(stream.ID)
+		if stream.Body != nil {
+			stream.Body.closeWithError(ErrStreamClosed)
+		}
+	})
+}
+
+// Reset closes the stream with err, when it ends without completing
+func (stream *Stream) Reset(err error) {
+	stream.closeOnce.Do(func() {
+		logger.Debug("stream(%d) Reset(%v)", stream.ID, err)
+		stream.err = err
+		close(stream.done)
+		stream.Conn.removeStream(stream.ID)
+		if stream.Body != nil {
+			stream.Body.closeWithError(err)
+		}
+	})
+}
+
+// Done is closed when the stream is closed or reset
+func (stream *Stream) Done() <-chan struct{} {
+	return stream.done
+}
+
+// Err returns the reason of Reset,
+// or ErrStreamClosed when the stream is closed without error
+func (stream *Stream) Err() error {
+	if stream.err == nil && stream.isClosed() {
+		return ErrStreamClosed
+	}
+	return stream.err
 }
 
 // Encode Header using HPACK
 func (stream *Stream) EncodeHeader(header http.Header) []byte {
 	headerList := hpack.ToHeaderList(header)
 	logger.Trace("sending header list %s", headerList)
-	return stream.HPackContext.Encode(*headerList)
-}
-
-// Decode Header using HPACK
-func (stream *Stream) DecodeHeader(headerBlockFragment []byte) http.Header {
-	stream.HPackContext.Decode(headerBlockFragment)
-	return stream.HPackContext.ES.ToHeader()
+	return stream.Conn.Encoder.Encode(*headerList)
 }
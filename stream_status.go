@@ -6,6 +6,7 @@ import (
 	"github.com/Jxck/logger"
 	"log"
 	xframe "minimalist-http2/frame"
+	"minimalist-http2/h2"
 )
 
 func init() {
@@ -91,11 +92,18 @@ func (c Context) String() string {
 //     ES: END_STREAM flag
 //     R:  RST_STREAM frame
 func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err error) {
+	stream.stateMu.Lock()
+	defer stream.stateMu.Unlock()
+
 	header := frame.Header()
 	frameType := header.Type
 	flags := header.Flags
 	state := stream.State
 
+	// ES (END_STREAM) is only defined on HEADERS and DATA
+	endStream := (frameType == xframe.HeadersFrameType || frameType == xframe.DataFrameType) &&
+		flags&xframe.HEADERS_END_STREAM == xframe.HEADERS_END_STREAM
+
 	logger.Trace("change state(%v) with %v frame type(%v)", state, context, frameType)
 
 	if frameType == xframe.SettingsFrameType ||
@@ -110,7 +118,7 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 			stream.changeState(OPEN)
 
 			// END_STREAM flag
-			if flags&xframe.HEADERS_END_STREAM == xframe.HEADERS_END_STREAM {
+			if endStream {
 				if context == RECV {
 					stream.changeState(HALF_CLOSED_REMOTE)
 				} else {
@@ -159,7 +167,7 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 		}
 	case OPEN:
 		// ES (END_STREAM)
-		if frameType == xframe.HEADERS_END_STREAM {
+		if endStream {
 			if context == SEND {
 				stream.changeState(HALF_CLOSED_LOCAL)
 			} else {
@@ -190,7 +198,7 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 
 		if context == RECV {
 			// ES (END_STREAM)
-			if frameType == xframe.HEADERS_END_STREAM {
+			if endStream {
 				stream.changeState(CLOSED)
 				return
 			}
@@ -218,15 +226,15 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 
 			msg := fmt.Sprintf("invalid frame type %v at %v state", frameType, state)
 			logger.Error(color.Red(msg))
-			return &H2Error{
-				ErrCode:             STREAM_CLOSED_ERROR,
+			return &h2.H2Error{
+				ErrCode:             h2.STREAM_CLOSED_ERROR,
 				AdditionalDebugData: msg,
 			}
 		}
 
 		if context == SEND {
 			// ES (end stream)
-			if flags&xframe.HEADERS_END_STREAM == xframe.HEADERS_END_STREAM {
+			if endStream {
 				stream.changeState(CLOSED)
 				return
 			}
@@ -255,8 +263,8 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 			}
 			msg := fmt.Sprintf("invalid frame type %v at %v state", frameType, state)
 			logger.Error(color.Red(msg))
-			return &H2Error{
-				ErrCode:             STREAM_CLOSED_ERROR,
+			return &h2.H2Error{
+				ErrCode:             h2.STREAM_CLOSED_ERROR,
 				AdditionalDebugData: msg,
 			}
 		}
@@ -265,12 +273,18 @@ func (stream *Stream) ChangeState(frame xframe.Frame, context Context) (err erro
 
 	msg := fmt.Sprintf("invalid frame type %v at %v state", frameType, state)
 	logger.Error(color.Red(msg))
-	return &H2Error{
-		ErrCode:             PROTOCOL_ERROR,
+	return &h2.H2Error{
+		ErrCode:             h2.PROTOCOL_ERROR,
 		AdditionalDebugData: msg,
 	}
 }
 
+func (stream *Stream) state() StreamState {
+	stream.stateMu.Lock()
+	defer stream.stateMu.Unlock()
+	return stream.State
+}
+
 func (stream *Stream) changeState(state StreamState) {
 	logger.Info("change stream (%d) state (%s -> %s)", stream.ID, stream.State, color.Pink(state.String()))
 	stream.State = state
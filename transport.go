@@ -2,30 +2,53 @@ package minimalist_http2
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	. "github.com/Jxck/color"
 	. "github.com/Jxck/logger"
+	"io"
 	"minimalist-http2/frame"
+	"minimalist-http2/h2"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// connections without streams are closed after this
+// when Transport.IdleTimeout is not set
+const DefaultIdleTimeout = 90 * time.Second
+
 // Transport implements http.RoundTriper
 // with RoundTrip(request) response
 type Transport struct {
-	Conn     *Connection
 	CertPath string
 	KeyPath  string
+	// connections without streams for IdleTimeout are closed,
+	// DefaultIdleTimeout if zero
+	IdleTimeout time.Duration
+	// limit of response header lists, advertised in
+	// SETTINGS_MAX_HEADER_LIST_SIZE, DefaultMaxHeaderListSize if zero
+	MaxHeaderListSize int32
+	// receive windows are auto-tuned up to MaxReceiveWindow
+	// by the bandwidth-delay product, they are fixed if zero
+	MaxReceiveWindow int32
+	// alternative services received in ALTSVC frames,
+	// created on first connection if nil
+	AltSvc *AltSvcCache
+
+	mu    sync.Mutex
+	conns map[string][]*Connection // pool by URL.Origin()
 }
 
 // connect tcp connection with host
-func (transport *Transport) Connect(url *URL) (err error) {
+func (transport *Transport) Connect(url *URL) (*Connection, error) {
 	address := url.Host + ":" + url.Port
 
 	// loading key pair
 	cert, err := tls.LoadX509KeyPair(transport.CertPath, transport.KeyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// setting TLS config
@@ -36,7 +59,7 @@ func (transport *Transport) Connect(url *URL) (err error) {
 	}
 	conn, err := tls.Dial("tcp", address, &config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// check connection state
@@ -45,31 +68,220 @@ func (transport *Transport) Connect(url *URL) (err error) {
 	Info("%v %v", Yellow("protocol"), state.NegotiatedProtocol)
 
 	Conn := NewConnection(conn)
+	Conn.Origin = url.Origin()
+	if transport.MaxHeaderListSize > 0 {
+		Conn.SetMaxHeaderListSize(transport.MaxHeaderListSize)
+	}
+	if transport.MaxReceiveWindow > 0 {
+		Conn.EnableWindowAutoTuning(transport.MaxReceiveWindow)
+	}
+
+	Conn.AltSvcCallBack = transport.altSvcCallBack(Conn)
 
 	// send Magic Octet
 	err = Conn.WriteMagic()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	go Conn.WriteLoop()
 
-	// send default settings to id 0
-	settingsFrame := frame.NewSettingsFrame(frame.UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
-	transport.Conn = Conn
+	// send settings to id 0
+	settingsFrame := frame.NewSettingsFrame(frame.UNSET, 0, Conn.Settings)
+	Conn.WriteFrame(settingsFrame)
+
+	// pending streams fail once the server stops sending
+	go func() {
+		Conn.ReadLoop()
+		Conn.Close()
+	}()
+
+	return Conn, nil
+}
+
+// altSvcCallBack caches ALTSVC frames received on conn
+func (transport *Transport) altSvcCallBack(conn *Connection) func(streamID uint32, origin, fieldValue string) {
+	transport.mu.Lock()
+	if transport.AltSvc == nil {
+		transport.AltSvc = NewAltSvcCache()
+	}
+	transport.mu.Unlock()
+
+	return func(streamID uint32, origin, fieldValue string) {
+		// RFC 7838 section 4
+		// ALTSVC for an origin the connection is not authoritative for
+		// MUST be ignored, the origin of a stream always passes
+		if streamID == 0 {
+			url, err := NewURL(origin)
+			if err != nil || !authoritative(conn, url) {
+				Debug("ignore ALTSVC for %s on %s", origin, conn.Origin)
+				return
+			}
+		}
+		err := transport.AltSvc.Update(origin, fieldValue)
+		if err != nil {
+			Error("invalid ALTSVC %q: %v", fieldValue, err)
+		}
+	}
+}
+
+// getConn returns a connection for url with a stream reserved on it.
+// A pooled connection for the origin is used while it has room for
+// SETTINGS_MAX_CONCURRENT_STREAMS of the server, then a connection
+// authoritative for the origin, and a new connection is dialed otherwise.
+func (transport *Transport) getConn(url *URL) (*Connection, error) {
+	origin := url.Origin()
+
+	transport.mu.Lock()
+	for _, conn := range transport.conns[origin] {
+		if conn.ReserveStream() {
+			transport.mu.Unlock()
+			return conn, nil
+		}
+	}
+	transport.mu.Unlock()
+
+	if conn := transport.coalescedConn(url); conn != nil {
+		return conn, nil
+	}
+
+	conn, err := transport.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	conn.ReserveStream()
+
+	transport.mu.Lock()
+	if transport.conns == nil {
+		transport.conns = make(map[string][]*Connection)
+	}
+	transport.conns[origin] = append(transport.conns[origin], conn)
+	transport.mu.Unlock()
+	return conn, nil
+}
+
+// putConn ends a stream reserved by getConn.
+// Idle connections are closed after IdleTimeout,
+// and connections going away as soon as their last stream ends.
+func (transport *Transport) putConn(conn *Connection) {
+	if !conn.ReleaseStream() {
+		return
+	}
+	if conn.GoingAway() {
+		transport.removeConn(conn)
+		return
+	}
+
+	timeout := transport.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+	time.AfterFunc(timeout, func() {
+		if conn.RetireIfIdle(timeout) {
+			Debug("close idle connection to %s", conn.Origin)
+			transport.removeConn(conn)
+		}
+	})
+}
+
+// removeConn drops conn from the pool and closes it with GOAWAY
+func (transport *Transport) removeConn(conn *Connection) {
+	transport.mu.Lock()
+	conns := transport.conns[conn.Origin]
+	for i, c := range conns {
+		if c == conn {
+			transport.conns[conn.Origin] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(transport.conns[conn.Origin]) == 0 {
+		delete(transport.conns, conn.Origin)
+	}
+	transport.mu.Unlock()
+
+	conn.GoAway(0, &h2.H2Error{ErrCode: h2.NO_ERROR})
+	conn.Close()
+}
+
+// coalescedConn returns a connection opened for another origin
+// which is authoritative for url, with a stream reserved on it
+func (transport *Transport) coalescedConn(url *URL) *Connection {
+	origin := url.Origin()
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	for _, conns := range transport.conns {
+		for _, conn := range conns {
+			if conn.Origin == origin || !authoritative(conn, url) {
+				continue
+			}
+			if !conn.ReserveStream() {
+				continue
+			}
+			Info("%v %s onto %s", Yellow("coalesce"), origin, conn.Origin)
+			return conn
+		}
+	}
+	return nil
+}
 
-	go Conn.ReadLoop()
+// RFC 8336 section 2.4
+// A connection is authoritative for the origin it was opened for, and for
+// another origin when the origin is in the origin set of the connection and
+// the certificate the server presented is valid for the host of the origin,
+// which requires the chain to be verified against trusted roots.
+func authoritative(conn *Connection, url *URL) bool {
+	origin := url.Origin()
+	if conn.Origin == origin {
+		return true
+	}
+	if !conn.InOriginSet(origin) {
+		return false
+	}
+	tlsConn, ok := conn.RW.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+	if err := verifyCertificate(certs, url.Host); err != nil {
+		Debug("%s is not authoritative for %s: %v", conn.Origin, origin, err)
+		return false
+	}
+	return true
+}
 
-	return
+// verifyCertificate checks that the chain the server presented leads to
+// a trusted root and is valid for host. Connections are dialed without
+// verification, so the hostname alone does not make the chain trustworthy.
+func verifyCertificate(certs []*x509.Certificate, host string) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: intermediates,
+	})
+	return err
 }
 
+// times a request refused by the server is sent again
+const maxRefusedRetry = 3
+
 // http.RoundTriper implementation
 func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	body := req.Body
+	if body == http.NoBody {
+		body = nil
+	}
+
 	// add headers
 	req.Header.Add("accept", "*/*")
 	req.Header.Add("x-http2-version", VERSION)
-	if req.ContentLength != 0 {
+	if req.ContentLength > 0 {
 		req.Header.Add("content-length", fmt.Sprintf("%d", req.ContentLength))
 	}
 
@@ -78,53 +290,147 @@ func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, er
 	url, err := NewURL(req.URL.String()) // err
 	if err != nil {
 		Error("%v", err)
+		if body != nil {
+			body.Close()
+		}
 		return nil, err
 	}
 	req = util.UpgradeRequest(req, url)
 
-	// establish tcp connection and handshake
-	err = transport.Connect(url)
-	if err != nil {
-		Error("%v", err)
-		return nil, err
+	for retry := 0; ; retry++ {
+		res, err = transport.roundTrip(req, url, body)
+
+		// section 8.1.4
+		// REFUSED_STREAM means the request was not processed,
+		// so it can be sent again with a new copy of the body
+		streamError, ok := err.(h2.StreamError)
+		if !ok || streamError.Code != h2.REFUSED_STREAM_ERROR || retry == maxRefusedRetry {
+			return res, err
+		}
+		if body != nil {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		Info("retry refused request to %s", url.Origin())
 	}
+}
 
+// roundTrip sends req with body on a new stream and waits for the response
+func (transport *Transport) roundTrip(req *http.Request, url *URL, body io.ReadCloser) (res *http.Response, err error) {
+	// stream delivers its own response
 	callback, response := TransportCallBack(req)
-	transport.Conn.CallBack = callback
-
-	// create stream
-	stream := transport.Conn.NewStream(<-NextClientStreamID)
-	transport.Conn.Streams[stream.ID] = stream
 
-	// send request header via HEADERS Frame
-	var flags frame.Flag = frame.HEADERS_END_STREAM + frame.HEADERS_END_HEADERS
-	headerBlockFragment := stream.EncodeHeader(req.Header)
-	Trace("encoded header block %v", headerBlockFragment)
-	frame := frame.NewHeadersFrame(flags, stream.ID, nil, headerBlockFragment, nil)
-	frame.Headers = req.Header
-	stream.Write(frame) // TODO: err
+	// reuse a pooled connection
+	// or establish tcp connection and handshake,
+	// a new one when stream IDs of the connection are exhausted
+	var conn *Connection
+	var stream *Stream
+	for {
+		conn, err = transport.getConn(url)
+		if err != nil {
+			Error("%v", err)
+			if body != nil {
+				body.Close()
+			}
+			return nil, err
+		}
+		// send request header via HEADERS Frame,
+		// which ends the stream when there is no body
+		stream, err = conn.OpenStream(callback, req.Header, body == nil)
+		if err == nil {
+			break
+		}
+		Info("reconnect to %s: %v", url.Origin(), err)
+		transport.putConn(conn)
+	}
+	// the stream is counted on the connection
+	// until the response body is read or closed
+	go func() {
+		<-stream.Done()
+		transport.putConn(conn)
+	}()
 
-	res = <-response
+	// the server may respond before the whole body is sent
+	if body != nil {
+		go writeBody(stream, body)
+	}
 
-	stream.Close()
+	select {
+	case res = <-response:
+	case <-stream.Done():
+		select {
+		case res = <-response: // completed right before the reset
+		default:
+			Error("stream(%d) closed without response: %v", stream.ID, stream.Err())
+			return nil, stream.Err()
+		}
+	}
 
 	Notice("\n%s", White(util.ResponseString(res)))
 
-	// TODO: send GOAWAY
-	// stream.Write(NewGoAwayFrame(0, stream.ID, NO_ERROR, nil))
-
 	return res, nil
 }
 
+// writeBody sends body in DATA frames and ends the stream with it.
+// The stream is reset when the body can not be read.
+func writeBody(stream *Stream, body io.ReadCloser) {
+	defer body.Close()
+
+	size := stream.Conn.PeerSetting(frame.SETTINGS_MAX_FRAME_SIZE)
+	if size < frame.DEFAULT_MAX_FRAME_SIZE {
+		size = frame.DEFAULT_MAX_FRAME_SIZE
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := stream.WriteData(buf[:n], false); err != nil {
+				Debug("stop sending body of stream(%d): %v", stream.ID, err)
+				return
+			}
+		}
+		if err == io.EOF {
+			// End Stream in empty DATA Frame
+			if err := stream.WriteData(nil, true); err != nil {
+				Debug("stop sending body of stream(%d): %v", stream.ID, err)
+			}
+			return
+		}
+		if err != nil {
+			Error("read request body: %v", err)
+			stream.Write(frame.NewRstStreamFrame(stream.ID, h2.CANCEL_ERROR))
+			stream.Reset(err)
+			return
+		}
+	}
+}
+
 func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
-	response := make(chan *http.Response)
+	// buffered for RoundTrip may stop waiting when the stream is reset
+	response := make(chan *http.Response, 1)
 	return func(stream *Stream) {
 
-		body := stream.Bucket.Body
+		body := stream.Body
 		headers := stream.Bucket.Headers
 
 		status, _ := strconv.Atoi(headers.Get(":status")) // err
 		headers.Del(":status")
+
+		// trailers declared in the Trailer header are known
+		// with nil values until the body reaches io.EOF
+		trailer := declaredTrailer(headers)
+		headers.Del("Trailer")
+
+		// -1 for unknown length, the body is still streaming
+		contentLength, err := strconv.ParseInt(headers.Get("content-length"), 10, 64)
+		if err != nil {
+			contentLength = -1
+		}
 		res := &http.Response{
 			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
 			StatusCode:    status,
@@ -133,12 +439,13 @@ func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
 			ProtoMinor:    1,
 			Header:        headers,
 			Body:          body,
-			ContentLength: int64(body.Len()),
+			ContentLength: contentLength,
 			// TransferEncoding []string
 			// Close bool
-			// Trailer Header
+			Trailer: trailer,
 			Request: req,
 		}
+		body.trailer = &res.Trailer
 
 		response <- res
 
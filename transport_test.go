@@ -0,0 +1,160 @@
+package minimalist_http2
+
+import (
+	"io"
+	"io/ioutil"
+	"minimalist-http2/frame"
+	"minimalist-http2/h2"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAltSvcCallBackAuthority(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	conn := NewConnection(client)
+	conn.Origin = "https://a.example:443"
+
+	transport := &Transport{}
+	conn.AltSvcCallBack = transport.altSvcCallBack(conn)
+
+	// the origin set alone does not make the connection authoritative
+	// without a certificate valid for the origin
+	conn.HandleOrigin(frame.NewOriginFrame([]string{"https://evil.example"}))
+	conn.HandleAltSvc(frame.NewAltSvcFrame(0, "https://evil.example", `h2="evil.example:443"`))
+	if altSvcs := transport.AltSvc.Lookup("https://evil.example"); altSvcs != nil {
+		t.Errorf("ALTSVC cached for an origin the connection is not authoritative for: %v", altSvcs)
+	}
+
+	conn.HandleAltSvc(frame.NewAltSvcFrame(0, "https://a.example", `h2="alt.example:443"`))
+	if altSvcs := transport.AltSvc.Lookup("https://a.example"); len(altSvcs) != 1 || altSvcs[0].Host != "alt.example" {
+		t.Errorf("Lookup(a.example) = %v", altSvcs)
+	}
+
+	// ALTSVC on a stream is for the origin of its request,
+	// which differs from the connection for coalesced streams
+	stream := conn.NewStream(1, nil)
+	stream.Origin = "https://b.example:443"
+	conn.HandleAltSvc(frame.NewAltSvcFrame(1, "", `h2="alt-b.example:443"`))
+	if altSvcs := transport.AltSvc.Lookup("https://b.example"); len(altSvcs) != 1 || altSvcs[0].Host != "alt-b.example" {
+		t.Errorf("Lookup(b.example) = %v", altSvcs)
+	}
+	if altSvcs := transport.AltSvc.Lookup("https://a.example"); len(altSvcs) != 1 || altSvcs[0].Host != "alt.example" {
+		t.Errorf("Lookup(a.example) = %v after ALTSVC on stream", altSvcs)
+	}
+
+	// a stream without a request origin is ignored
+	conn.NewStream(3, nil)
+	conn.HandleAltSvc(frame.NewAltSvcFrame(3, "", `h2="alt-c.example:443"`))
+	if altSvcs := transport.AltSvc.Lookup("https://a.example"); len(altSvcs) != 1 || altSvcs[0].Host != "alt.example" {
+		t.Errorf("Lookup(a.example) = %v after ALTSVC on stream without origin", altSvcs)
+	}
+}
+
+// openTestRequest sends a GET request on a new stream of conn
+func openTestRequest(t *testing.T, conn *Connection) (*Stream, chan *http.Response) {
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, response := TransportCallBack(req)
+	stream, err := conn.OpenStream(callback, testRequestHeader("GET", "/"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, response
+}
+
+func TestTransportInformationalAndTrailers(t *testing.T) {
+	conn, peer := newTestClient(t)
+	stream, response := openTestRequest(t, conn)
+	peer.expect(func(f frame.Frame) bool {
+		return f.Header().Type == frame.HeadersFrameType
+	})
+
+	peer.writeHeaderBlock(1, http.Header{":status": {"103"}, "Link": {"</style.css>; rel=preload"}}, frame.UNSET)
+	peer.writeHeaderBlock(1, http.Header{":status": {"200"}, "X-Final": {"1"}, "Trailer": {"X-Trailer"}}, frame.UNSET)
+	peer.write(frame.NewDataFrame(frame.UNSET, 1, []byte("ok"), nil))
+
+	var res *http.Response
+	select {
+	case res = <-response:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-Final") != "1" || res.Header.Get("Link") != "" {
+		t.Fatalf("response = %d %v, want 200 of the final HEADERS", res.StatusCode, res.Header)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(res.Body, b); err != nil || string(b) != "ok" {
+		t.Fatalf("body = %q, %v", b, err)
+	}
+
+	// trailers are filled in by the reader at io.EOF, not on arrival
+	peer.writeHeaderBlock(1, http.Header{"X-Trailer": {"v"}}, frame.HEADERS_END_STREAM)
+	select {
+	case <-stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed")
+	}
+	if value, declared := res.Trailer["X-Trailer"]; !declared || value != nil {
+		t.Errorf("Trailer before io.EOF = %v, want declared X-Trailer without value", res.Trailer)
+	}
+	if rest, err := ioutil.ReadAll(res.Body); err != nil || len(rest) != 0 {
+		t.Fatalf("rest of body = %q, %v", rest, err)
+	}
+	if value := res.Trailer.Get("X-Trailer"); value != "v" {
+		t.Errorf("Trailer after io.EOF = %v, want X-Trailer: v", res.Trailer)
+	}
+}
+
+func TestTransportMalformedHeaders(t *testing.T) {
+	final := http.Header{":status": {"200"}}
+	cases := []struct {
+		name   string
+		blocks []http.Header
+		flags  []frame.Flag
+	}{
+		{
+			"trailers without END_STREAM",
+			[]http.Header{final, {"X-Trailer": {"v"}}},
+			[]frame.Flag{frame.UNSET, frame.UNSET},
+		},
+		{
+			"pseudo-header field in trailers",
+			[]http.Header{final, {":status": {"200"}}},
+			[]frame.Flag{frame.UNSET, frame.HEADERS_END_STREAM},
+		},
+		{
+			"informational response with END_STREAM",
+			[]http.Header{{":status": {"103"}}},
+			[]frame.Flag{frame.HEADERS_END_STREAM},
+		},
+		{
+			"101 response",
+			[]http.Header{{":status": {"101"}}},
+			[]frame.Flag{frame.UNSET},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, peer := newTestClient(t)
+			stream, _ := openTestRequest(t, conn)
+			peer.expect(func(f frame.Frame) bool {
+				return f.Header().Type == frame.HeadersFrameType
+			})
+			for i, header := range c.blocks {
+				peer.writeHeaderBlock(1, header, c.flags[i])
+			}
+			peer.expect(isRstStream(1, h2.PROTOCOL_ERROR))
+			<-stream.Done()
+			if err, ok := stream.Err().(h2.StreamError); !ok || err.Code != h2.PROTOCOL_ERROR {
+				t.Errorf("stream error = %v, want PROTOCOL_ERROR", stream.Err())
+			}
+		})
+	}
+}
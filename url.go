@@ -3,6 +3,7 @@ package minimalist_http2
 import (
 	"fmt"
 	"log"
+	"net/http"
 	neturl "net/url"
 	"strings"
 )
@@ -52,3 +53,28 @@ func (url *URL) SplitHostPort() (err error) {
 	}
 	return
 }
+
+// Origin returns the origin of the url as scheme://host:port
+// with the port always present, so it can be used as a key
+func (url *URL) Origin() string {
+	return fmt.Sprintf("%s://%s:%s", url.Scheme, url.Host, url.Port)
+}
+
+// normalize ASCII serialization of origin (RFC 6454) into URL.Origin()
+func originKey(origin string) (string, error) {
+	url, err := NewURL(origin)
+	if err != nil {
+		return "", err
+	}
+	return url.Origin(), nil
+}
+
+// requestOrigin returns the origin of a request as URL.Origin()
+// from its pseudo-header fields, empty when they are not valid
+func requestOrigin(header http.Header) string {
+	key, err := originKey(header.Get(":scheme") + "://" + header.Get(":authority"))
+	if err != nil {
+		return ""
+	}
+	return key
+}
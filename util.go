@@ -30,38 +30,18 @@ var MustHeader = map[string]string{
 type Util struct {
 }
 
-var (
-	NextClientStreamID chan uint32 = util.NextID(1)
-	NextServerStreamID chan uint32 = util.NextID(2)
-)
-
-func (u Util) NextID(id uint32) chan uint32 {
-	idChan := make(chan uint32)
-	go func() {
-		for {
-			if id >= 4294967295 || id < 0 { // 2^32-1 or invalid
-				log.Println("stream id too big or invali,return to 0")
-				id = 0
-			}
-			idChan <- id
-			id += 2
-		}
-	}()
-	return idChan
-}
-
 func (u Util) UpgradeRequest(req *http.Request, url *URL) *http.Request {
 	req.Header.Add(":authority", url.Host)
 	req.Header.Add(":method", req.Method)
 	req.Header.Add(":path", url.Path)
-	req.Header.Add(":schema", url.Scheme)
+	req.Header.Add(":scheme", url.Scheme)
 	return req
 }
 
 func (u Util) RequestString(req *http.Request) string {
 	str := fmt.Sprintf("%v %v %v", req.Method, req.URL, req.Proto)
 	for name, value := range req.Header {
-		str += fmt.Sprintf("\n$s: $s", name, strings.Join(value, ","))
+		str += fmt.Sprintf("\n%s: %s", name, strings.Join(value, ","))
 	}
 	return str
 }
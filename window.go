@@ -5,15 +5,34 @@ import (
 	"github.com/Jxck/color"
 	"github.com/Jxck/logger"
 	"minimalist-http2/frame"
+	"sync"
 )
 
+// MAX_WINDOW_SIZE is the largest flow control window, section 6.9.1
+const MAX_WINDOW_SIZE int64 = 1<<31 - 1
+
 type Window struct {
-	initialSize     int32
-	currentSize     int32
-	threshold       int32
+	mu          sync.Mutex
+	initialSize int32
+	// receive window the peer sees, reduced by data received
+	currentSize int32
+	threshold   int32
+	// data consumed by the application and not granted again yet
+	consumed        int32
 	peerInitialSize int32
 	peerCurrentSize int32
 	peerThreshold   int32
+	// closed when the peer window grows, for writers waiting in TakePeer
+	peerUpdated chan struct{}
+	// writers waiting in AcquirePeer, served in order
+	queue []*peerWaiter
+}
+
+// peerWaiter is a writer in the queue of AcquirePeer,
+// ready is closed when it's the head and the window is open
+type peerWaiter struct {
+	ready    chan struct{}
+	signaled bool
 }
 
 func NewDefaultWindow() *Window {
@@ -38,53 +57,190 @@ func NewWindow(initialWindow, peerInitialWindow int32) *Window {
 	}
 }
 
-func (window *Window) UpdateInitialSize(newInitialWindowSize int32) {
-	curInitialWindowSize := window.initialSize
+// section 6.9.2
+// SETTINGS_INITIAL_WINDOW_SIZE of the peer adjusts the peer window
+// by the difference between the new value and the old value.
+// It returns false when the window would exceed MAX_WINDOW_SIZE.
+func (window *Window) UpdateInitialSize(newInitialWindowSize int32) bool {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	curInitialWindowSize := window.peerInitialSize
 	curWindowSize := window.peerCurrentSize
-	newWindowSize := newInitialWindowSize - (window.initialSize - curWindowSize)
+	if int64(newInitialWindowSize)-int64(curInitialWindowSize)+int64(curWindowSize) > MAX_WINDOW_SIZE {
+		return false
+	}
+	newWindowSize := newInitialWindowSize - (curInitialWindowSize - curWindowSize)
 
 	window.peerCurrentSize = newWindowSize
-	window.initialSize = newInitialWindowSize
+	window.peerInitialSize = newInitialWindowSize
+	window.notifyPeer()
 	logger.Trace(color.Brown(`update initial window size
 	"New WindowSize(%v)" = "New InitialWindowSize(%v)" - ("Current InitialWindow ize(%v)" - "Current WindowSize(%v)")`),
 		newWindowSize, newInitialWindowSize, curInitialWindowSize, curWindowSize)
+	return true
 }
 
 func (window *Window) Update(windowSizeIncrement int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	cur := window.currentSize
 	window.currentSize = cur + windowSizeIncrement
 	logger.Trace(color.Brown("increment current window size (%v) + increment (%v) = (%v)"), cur, windowSizeIncrement, window.currentSize)
 }
 
-func (window *Window) UpdatePeer(windowSizeIncrement int32) {
+// UpdatePeer grows the peer window by WINDOW_UPDATE. It returns false
+// and leaves the window as is when it would exceed MAX_WINDOW_SIZE.
+func (window *Window) UpdatePeer(windowSizeIncrement int32) bool {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	cur := window.peerCurrentSize
+	if int64(cur)+int64(windowSizeIncrement) > MAX_WINDOW_SIZE {
+		return false
+	}
 	window.peerCurrentSize = cur + windowSizeIncrement
 	logger.Trace(color.Brown("increment peer window size (%v) + increment (%v) = (%v)"), cur, windowSizeIncrement, window.peerCurrentSize)
+	window.notifyPeer()
+	return true
+}
 
+// wake up writers waiting for the peer window, window.mu is held
+func (window *Window) notifyPeer() {
+	if window.peerCurrentSize <= 0 {
+		return
+	}
+	if window.peerUpdated != nil {
+		close(window.peerUpdated)
+		window.peerUpdated = nil
+	}
+	if len(window.queue) > 0 && !window.queue[0].signaled {
+		window.queue[0].signaled = true
+		close(window.queue[0].ready)
+	}
 }
 
-func (window *Window) Consume(length int32) (update int32) {
+// Receive reduces the window by length of DATA received. It returns false
+// when the peer sent more than the window allows, section 6.9.1
+func (window *Window) Receive(length int32) bool {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	if length > window.currentSize {
+		return false
+	}
 	window.currentSize -= length
-	if window.currentSize < window.threshold {
-		update = window.initialSize - window.currentSize
+	return true
+}
+
+// Grow raises the receive window to size for auto-tuning and returns
+// the increment, which is 0 when the window is already as large.
+func (window *Window) Grow(size int32) (increment int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	if size <= window.initialSize {
+		return 0
+	}
+	increment = size - window.initialSize
+	window.initialSize = size
+	window.currentSize += increment
+	window.threshold = size/2 + 1
+	return increment
+}
+
+// Consume records length consumed by the application and returns the
+// increment for WINDOW_UPDATE, once the window without the consumed data
+// is below the threshold. The increment is already added back to the window.
+func (window *Window) Consume(length int32) (update int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	window.consumed += length
+	if window.initialSize-window.consumed < window.threshold {
+		update = window.consumed
+		window.currentSize += update
+		window.consumed = 0
 	}
 	return update
 }
 
-func (window *Window) ConsumePeer(length int32) {
-	current := window.peerCurrentSize
-	window.peerCurrentSize = current - length
-	logger.Trace("consume peer window size (%v) - (%v) = (%v)", current, length, window.peerCurrentSize)
+// TakePeer consumes up to length of the peer window. When the window
+// is empty, it returns 0 and a channel closed once the window grows.
+func (window *Window) TakePeer(length int32) (int32, <-chan struct{}) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	if window.peerCurrentSize <= 0 {
+		if window.peerUpdated == nil {
+			window.peerUpdated = make(chan struct{})
+		}
+		return 0, window.peerUpdated
+	}
+	return window.takePeer(length), nil
+}
+
+// AcquirePeer consumes up to length of the peer window, blocking while it
+// is empty. Writers get the window in the order they asked for it, so a
+// writer asking again after sending waits behind the others. It returns
+// 0 and false when cancel is closed first.
+func (window *Window) AcquirePeer(length int32, cancel <-chan struct{}) (int32, bool) {
+	window.mu.Lock()
+	if len(window.queue) == 0 && window.peerCurrentSize > 0 {
+		length = window.takePeer(length)
+		window.mu.Unlock()
+		return length, true
+	}
+	waiter := &peerWaiter{ready: make(chan struct{})}
+	window.queue = append(window.queue, waiter)
+	window.notifyPeer()
+	window.mu.Unlock()
+
+	for {
+		select {
+		case <-waiter.ready:
+			window.mu.Lock()
+			if window.peerCurrentSize <= 0 {
+				// closed again before this writer took it
+				waiter.ready, waiter.signaled = make(chan struct{}), false
+				window.mu.Unlock()
+				continue
+			}
+			window.queue = window.queue[1:]
+			length = window.takePeer(length)
+			window.notifyPeer()
+			window.mu.Unlock()
+			return length, true
+		case <-cancel:
+			window.mu.Lock()
+			for i, w := range window.queue {
+				if w == waiter {
+					window.queue = append(window.queue[:i], window.queue[i+1:]...)
+					break
+				}
+			}
+			// pass the turn on when it was given
+			window.notifyPeer()
+			window.mu.Unlock()
+			return 0, false
+		}
+	}
 }
 
-func (window *Window) Consumable(length int32) int32 {
-	if window.peerCurrentSize < length {
-		return window.peerCurrentSize
-	} else {
-		return length
+// takePeer consumes up to length of the open peer window, window.mu is held
+func (window *Window) takePeer(length int32) int32 {
+	if length > window.peerCurrentSize {
+		length = window.peerCurrentSize
 	}
+	window.peerCurrentSize -= length
+	logger.Trace("take peer window size (%v) - (%v) = (%v)", window.peerCurrentSize+length, length, window.peerCurrentSize)
+	return length
+}
+
+// ReturnPeer gives back length taken by TakePeer but not sent
+func (window *Window) ReturnPeer(length int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	window.peerCurrentSize += length
+	window.notifyPeer()
 }
 
 func (window *Window) String() string {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	return fmt.Sprintf(color.Yellow("window: curr(%d) - peer(%d)"), window.currentSize, window.peerCurrentSize)
 }
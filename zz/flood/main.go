@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	h2 "minimalist-http2"
+	"minimalist-http2/frame"
+	"minimalist-http2/hpack"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+func dial(addr string) *tls.Conn {
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{h2.VERSION}})
+	if err != nil {
+		panic(err)
+	}
+	c.Write([]byte(h2.CONNECTION_PREFACE))
+	return c
+}
+
+// readUntilGoAway prints the first GOAWAY or a timeout
+func readUntilGoAway(name string, c *tls.Conn) {
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	frames := 0
+	for {
+		f, err := frame.ReadFrame(c, h2.DefaultSettings)
+		if err != nil {
+			fmt.Println(name, "read error", err, "after frames", frames)
+			return
+		}
+		frames++
+		if g, ok := f.(*frame.GoAwayFrame); ok {
+			fmt.Println(name, "GOAWAY", g.ErrorCode, string(g.AdditionalDebugData))
+			return
+		}
+	}
+}
+
+func main() {
+	cert, _ := tls.LoadX509KeyPair("/tmp/c.pem", "/tmp/k.pem")
+	ln, _ := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{h2.VERSION}})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h2.HandleTLSConnection(c, handler)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr).String()
+	enc := hpack.NewEncoder(4096)
+	block := enc.Encode(*hpack.ToHeaderList(http.Header{":method": {"GET"}, ":scheme": {"https"}, ":authority": {"localhost"}, ":path": {"/"}}))
+
+	if len(os.Args) < 2 || os.Args[1] == "continuation" {
+		c := dial(addr)
+		frame.NewSettingsFrame(frame.UNSET, 0, map[frame.SettingsID]int32{}).Write(c)
+		frame.NewHeadersFrame(frame.HEADERS_END_STREAM, 1, nil, block, nil).Write(c)
+		go func() {
+			for i := 0; i < 200000; i++ {
+				f := frame.NewContinuationFrame(frame.UNSET, 1, make([]byte, 16000))
+				if f.Write(c) != nil {
+					return
+				}
+			}
+		}()
+		readUntilGoAway("continuation", c)
+	}
+	for _, name := range []string{"frame-size-0", "enable-push-2"} {
+		if len(os.Args) >= 2 && os.Args[1] != name {
+			continue
+		}
+		settings := map[frame.SettingsID]int32{frame.SETTINGS_MAX_FRAME_SIZE: 0}
+		if name == "enable-push-2" {
+			settings = map[frame.SettingsID]int32{frame.SETTINGS_ENABLE_PUSH: 2}
+		}
+		c := dial(addr)
+		frame.NewSettingsFrame(frame.UNSET, 0, settings).Write(c)
+		frame.NewHeadersFrame(frame.HEADERS_END_STREAM|frame.HEADERS_END_HEADERS, 1, nil, block, nil).Write(c)
+		readUntilGoAway(name, c)
+	}
+	var m runtimeStats
+	m.print()
+}
+
+type runtimeStats struct{}
+
+func (runtimeStats) print() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Println("heap MB", ms.HeapAlloc>>20)
+}
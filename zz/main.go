@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+	"io/ioutil"
+	"math/big"
+	h2 "minimalist-http2"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+func main() {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"localhost"}}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	kb, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile("/tmp/c.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile("/tmp/k.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	cert, _ := tls.LoadX509KeyPair("/tmp/c.pem", "/tmp/k.pem")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{h2.VERSION}})
+	if err != nil {
+		panic(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		if r.URL.Path == "/sse" {
+			w.Header().Set("content-type", "text/event-stream")
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte("b"))
+			return
+		}
+		if r.URL.Path == "/trailer-nobody" {
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("Grpc-Status", "7")
+			return
+		}
+		if r.URL.Path == "/trailer" {
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte("t"))
+			w.Header().Set("Grpc-Status", "0")
+			w.Header().Set(http.TrailerPrefix+"X-Extra", "e")
+			return
+		}
+		if r.URL.Path == "/bighdr" {
+			w.Header().Set("X-Big", strings.Repeat("h", 40000))
+			fmt.Fprintf(w, "req=%d", len(r.Header.Get("X-Req")))
+			return
+		}
+		if r.URL.Path == "/early" {
+			w.Write([]byte("early"))
+			return
+		}
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(204)
+			return
+		}
+		if r.URL.Path == "/big" {
+			w.Write([]byte(strings.Repeat("z", 1<<20)))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "path=%s body=%d", r.URL.Path, len(body))
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Println("ACCEPT")
+			tc := c.(*tls.Conn)
+			tc.Handshake()
+			go h2.HandleTLSConnection(tc, handler, h2.WithMaxHeaderListSize(45000), h2.WithWindowAutoTuning(8<<20))
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	client := &http.Client{Transport: &h2.Transport{CertPath: "/tmp/c.pem", KeyPath: "/tmp/k.pem", MaxReceiveWindow: 16<<20}}
+	var wg sync.WaitGroup
+	fail := false
+	for i := 0; i < 1; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/p%d", i)
+			if i%3 == 0 {
+				path = "/slow"
+			}
+			res, err := client.Get(fmt.Sprintf("https://localhost:%d%s", port, path))
+			if err != nil {
+				fmt.Println("ERR", err)
+				fail = true
+				return
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			want := "path=" + path + " body=0"
+			if string(b) != want {
+				fmt.Println("MISMATCH", string(b), want)
+				fail = true
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, n := range []int{5, 40000, 60000} {
+		res, err := client.Post(fmt.Sprintf("https://localhost:%d/post", port), "text/plain", strings.NewReader(strings.Repeat("x", n)))
+		if err != nil {
+			fmt.Println("ERR", err)
+			fail = true
+			continue
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		fmt.Println("POST", string(b))
+	}
+	{
+		res, err := client.Post(fmt.Sprintf("https://localhost:%d/refuse", port), "text/plain", strings.NewReader("abc"))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b, _ := ioutil.ReadAll(res.Body)
+			fmt.Println("POST", string(b))
+		}
+	}
+	{
+		start := time.Now()
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/big", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			fmt.Println("BIG headers", res.ContentLength, time.Since(start) < time.Second)
+			b, err := ioutil.ReadAll(res.Body)
+			fmt.Println("BIG", len(b), err)
+			res.Body.Close()
+		}
+		res, err = client.Get(fmt.Sprintf("https://localhost:%d/big", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b := make([]byte, 100)
+			n, err := io.ReadFull(res.Body, b)
+			fmt.Println("PARTIAL", n, err, res.Body.Close())
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			pw.Write([]byte(strings.Repeat("y", 10000)))
+		}
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("POST", fmt.Sprintf("https://localhost:%d/chunked", port), ioutil.NopCloser(pr))
+	fmt.Println("CL", req.ContentLength)
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Println("ERR", err)
+	} else {
+		b, _ := ioutil.ReadAll(res.Body)
+		fmt.Println("POST", string(b))
+	}
+	for i := 0; i < 6; i++ {
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/seq%d", port, i))
+		if err != nil {
+			fmt.Println("ERR", err)
+			fail = true
+			continue
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		fmt.Println("SEQ", string(b))
+	}
+	{
+		start := time.Now()
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/sse", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b := make([]byte, 1)
+			io.ReadFull(res.Body, b)
+			fmt.Println("SSE first", string(b), time.Since(start) < 300*time.Millisecond, res.Header.Get("content-type"))
+			rest, err := ioutil.ReadAll(res.Body)
+			fmt.Println("SSE rest", string(rest), err)
+		}
+		res, err = client.Get(fmt.Sprintf("https://localhost:%d/empty", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b, err := ioutil.ReadAll(res.Body)
+			fmt.Println("EMPTY", res.StatusCode, len(b), err)
+		}
+	}
+	{
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/trailer", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b, err := ioutil.ReadAll(res.Body)
+			fmt.Println("TRAILER", string(b), err, res.Header, res.Trailer)
+		}
+	}
+	{
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/trailer-nobody", port))
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b, err := ioutil.ReadAll(res.Body)
+			fmt.Println("TRAILER-NOBODY", string(b), err, res.Header, res.Trailer)
+		}
+	}
+	{
+		req, _ := http.NewRequest("GET", fmt.Sprintf("https://localhost:%d/bighdr", port), nil)
+		req.Header.Set("X-Req", strings.Repeat("q", 50000))
+		res, err := client.Do(req)
+		if err != nil {
+			fmt.Println("ERR", err)
+		} else {
+			b, err := ioutil.ReadAll(res.Body)
+			fmt.Println("BIGHDR", res.StatusCode, string(b), err, len(res.Header.Get("X-Big")))
+		}
+	}
+	{
+		c2 := &http.Client{Transport: &h2.Transport{CertPath: "/tmp/c.pem", KeyPath: "/tmp/k.pem", MaxHeaderListSize: 1000}}
+		res, err := c2.Get(fmt.Sprintf("https://localhost:%d/bighdr", port))
+		fmt.Println("CLIENTLIMIT", res, err)
+		res, err = c2.Get(fmt.Sprintf("https://localhost:%d/after", port))
+		if err == nil {
+			b, _ := ioutil.ReadAll(res.Body)
+			fmt.Println("AFTER", string(b))
+		} else {
+			fmt.Println("AFTER ERR", err)
+		}
+	}
+	{
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res, err := client.Get(fmt.Sprintf("https://localhost:%d/big", port))
+				if err != nil {
+					fmt.Println("ERR", err)
+					return
+				}
+				b, err := ioutil.ReadAll(res.Body)
+				fmt.Println("PAR", i, len(b), err)
+			}(i)
+		}
+		wg.Wait()
+	}
+	if fail {
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	h2 "minimalist-http2"
+	"minimalist-http2/frame"
+	"minimalist-http2/hpack"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func main() {
+	cert, _ := tls.LoadX509KeyPair("/tmp/c.pem", "/tmp/k.pem")
+	ln0, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln := ln0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("z", 1<<20)))
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*net.TCPConn).SetWriteBuffer(16 << 10)
+			tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{h2.VERSION}})
+			tc.Handshake()
+			go h2.HandleTLSConnection(tc, handler)
+		}
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().(*net.TCPAddr).String())
+	if err != nil {
+		panic(err)
+	}
+	raw.(*net.TCPConn).SetReadBuffer(16 << 10)
+	c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{h2.VERSION}})
+	if err != nil {
+		panic(err)
+	}
+	c.Write([]byte(h2.CONNECTION_PREFACE))
+	frame.NewSettingsFrame(frame.UNSET, 0, map[frame.SettingsID]int32{frame.SETTINGS_INITIAL_WINDOW_SIZE: 0}).Write(c)
+	frame.NewWindowUpdateFrame(0, 1<<30).Write(c)
+	enc := hpack.NewEncoder(4096)
+	hdr := func(id uint32, tree *frame.DependencyTree) {
+		h := http.Header{":method": {"GET"}, ":scheme": {"https"}, ":authority": {"localhost"}, ":path": {"/big"}}
+		flags := frame.Flag(frame.HEADERS_END_HEADERS) | frame.HEADERS_END_STREAM
+		if tree != nil {
+			flags |= frame.HEADERS_PRIORITY
+		}
+		frame.NewHeadersFrame(flags, id, tree, enc.Encode(*hpack.ToHeaderList(h)), nil).Write(c)
+	}
+	// all streams blocked by a zero window until the windows open together
+	hdr(1, &frame.DependencyTree{Weight: 0})
+	hdr(3, &frame.DependencyTree{Weight: 255})
+	hdr(5, &frame.DependencyTree{StreamDependency: 3, Weight: 15})
+	hdr(7, &frame.DependencyTree{StreamDependency: 0, Exclusive: true, Weight: 15})
+	settings := map[frame.SettingsID]int32{frame.SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30}
+	frame.NewSettingsFrame(frame.UNSET, 0, settings).Write(c)
+
+	var seq []uint32
+	ended := 0
+	for ended < 4 {
+		time.Sleep(200 * time.Microsecond)
+		f, err := frame.ReadFrame(c, h2.DefaultSettings)
+		if err != nil {
+			panic(err)
+		}
+		if f.Header().Type == frame.DataFrameType {
+			if f.Header().Length > 0 {
+				seq = append(seq, f.Header().StreamID)
+			}
+			if f.Header().Flags.Has(frame.DATA_END_STREAM) {
+				ended++
+				fmt.Println("END", f.Header().StreamID, "after", len(seq))
+			}
+		}
+	}
+	count := map[uint32]int{}
+	for i, id := range seq {
+		count[id]++
+		if i == 99 || i == 199 {
+			fmt.Println("first", i+1, count)
+		}
+	}
+}